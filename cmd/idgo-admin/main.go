@@ -0,0 +1,427 @@
+// idgo-admin manages the keys of idgo, through a running idgo or directly
+// in the storage.
+//
+//	idgo-admin [flags] list [pattern]
+//	idgo-admin [flags] create <key> <value> [step]
+//	idgo-admin [flags] describe <key>
+//	idgo-admin [flags] rebase <key> <value>
+//	idgo-admin [flags] delete <key>
+//	idgo-admin -config file [flags] export [file]
+//	idgo-admin -config file [flags] import <file>
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flike/idgo/config"
+	"github.com/flike/idgo/server"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	addr       = flag.String("addr", "", "address of a running idgo, such as 127.0.0.1:6389")
+	configFile = flag.String("config", "", "idgo config file, to manage the keys in the storage directly")
+	user       = flag.String("user", "", "user name of AUTH")
+	password   = flag.String("password", "", "password of AUTH")
+	db         = flag.Int("db", 0, "namespace of the keys")
+	tlsCA      = flag.String("tls-ca", "", "CA file to verify idgo, enables TLS")
+	tlsCert    = flag.String("tls-cert", "", "client certificate file")
+	tlsKey     = flag.String("tls-key", "", "client key file")
+	format     = flag.String("format", "table", "output format [table|json]")
+	force      = flag.Bool("force", false, "rebase the key to a value lower than its high-water mark")
+	yes        = flag.Bool("yes", false, "delete the key without confirmation")
+	dumpFormat = flag.String("dump-format", server.DumpFormatNDJSON, "format of export [json|ndjson]")
+	margin     = flag.Int64("margin", server.DefaultRestoreMargin, "ids skipped over the exported high-water mark by import")
+)
+
+// admin is the operations on keys of a running idgo or the storage
+type admin interface {
+	Keys(pattern string) ([]string, error)
+	Describe(key string) (*server.KeyInfo, error)
+	Create(key string, value int64, step int64) error
+	Rebase(key string, value int64) error
+	Delete(key string) (bool, error)
+	Close() error
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: idgo-admin (-addr host:port | -config file) [flags] <command> [args]
+
+commands:
+  list [pattern]              list the keys with their values
+  create <key> <value> [step] create a key
+  describe <key>              show a key
+  rebase <key> <value>        set the value of a key
+  delete <key>                delete a key
+  export [file]               export all the keys of the storage, needs -config
+  import <file>               import the exported keys to the storage, needs -config
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "json" {
+		fatal(fmt.Errorf("%s:invalid format", *format))
+	}
+
+	a, err := newAdmin()
+	if err != nil {
+		fatal(err)
+	}
+	err = run(a, flag.Args(), os.Stdin, os.Stdout)
+	a.Close()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "idgo-admin: %v\n", err)
+	os.Exit(1)
+}
+
+func newAdmin() (admin, error) {
+	switch {
+	case len(*addr) != 0 && len(*configFile) != 0:
+		return nil, errors.New("use either -addr or -config")
+	case len(*addr) != 0:
+		return newRemoteAdmin()
+	case len(*configFile) != 0:
+		cfg, err := config.ParseConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		store, err := server.NewSegmentStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Init(); err != nil {
+			store.Close()
+			return nil, err
+		}
+		sa, err := server.NewStoreAdmin(store, *db, cfg.Namespaces)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		storage := cfg.Storage
+		if len(storage) == 0 {
+			storage = server.StorageMySQL
+		}
+		return &storeAdmin{StoreAdmin: sa, store: store, storage: storage, namespaces: cfg.Namespaces}, nil
+	}
+	return nil, errors.New("use -addr or -config")
+}
+
+type storeAdmin struct {
+	*server.StoreAdmin
+	store      server.SegmentStore
+	storage    string
+	namespaces int
+}
+
+func (a *storeAdmin) Close() error {
+	return a.store.Close()
+}
+
+func run(a admin, args []string, in io.Reader, out io.Writer) error {
+	command, args := args[0], args[1:]
+	argc := map[string][2]int{
+		"list":     {0, 1},
+		"create":   {2, 3},
+		"describe": {1, 1},
+		"rebase":   {2, 2},
+		"delete":   {1, 1},
+		"export":   {0, 1},
+		"import":   {1, 1},
+	}
+	n, ok := argc[command]
+	if !ok {
+		return fmt.Errorf("%s:unknown command", command)
+	}
+	if len(args) < n[0] || len(args) > n[1] {
+		return fmt.Errorf("%s:wrong number of arguments", command)
+	}
+	if command == "export" || command == "import" {
+		sa, ok := a.(*storeAdmin)
+		if !ok {
+			return fmt.Errorf("%s needs -config", command)
+		}
+		if command == "export" {
+			return export(sa, args, out)
+		}
+		return restore(sa, args[0], in, out)
+	}
+	var value, step int64
+	var err error
+	if len(args) > 1 {
+		if value, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return fmt.Errorf("%s:value is not an integer", args[1])
+		}
+	}
+	if len(args) > 2 {
+		if step, err = strconv.ParseInt(args[2], 10, 64); err != nil || step <= 0 {
+			return fmt.Errorf("%s:step is not a positive integer", args[2])
+		}
+	}
+
+	switch command {
+	case "list":
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		keys, err := a.Keys(pattern)
+		if err != nil {
+			return err
+		}
+		infos := make([]*server.KeyInfo, 0, len(keys))
+		for _, key := range keys {
+			info, err := a.Describe(key)
+			if err != nil {
+				return err
+			}
+			// the key may be deleted after listing
+			if info != nil {
+				infos = append(infos, info)
+			}
+		}
+		return printKeys(out, infos)
+	case "create":
+		if err := a.Create(args[0], value, step); err != nil {
+			return err
+		}
+		return describe(a, args[0], out)
+	case "describe":
+		return describe(a, args[0], out)
+	case "rebase":
+		info, err := a.Describe(args[0])
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			return fmt.Errorf("%s:key does not exist", args[0])
+		}
+		if value < info.HighWater && !*force {
+			return fmt.Errorf("%d:value is lower than the high-water mark %d, the ids may be duplicated, use -force to rebase",
+				value, info.HighWater)
+		}
+		if err := a.Rebase(args[0], value); err != nil {
+			return err
+		}
+		return describe(a, args[0], out)
+	case "delete":
+		if !*yes {
+			fmt.Fprintf(out, "type the key name %q to delete it: ", args[0])
+			line, _ := bufio.NewReader(in).ReadString('\n')
+			if strings.TrimSpace(line) != args[0] {
+				return errors.New("delete is not confirmed")
+			}
+		}
+		deleted, err := a.Delete(args[0])
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("%s:key does not exist", args[0])
+		}
+		fmt.Fprintf(out, "deleted %s\n", args[0])
+	}
+	return nil
+}
+
+// export writes the dump to a temporary file and renames it to file, so
+// a failed export never leaves a partial dump.
+func export(a *storeAdmin, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "-" {
+		_, err := server.Dump(a.store, a.storage, out, *dumpFormat)
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(args[0]), filepath.Base(args[0])+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := server.Dump(a.store, a.storage, f, *dumpFormat)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "exported %d keys to %s\n", n, args[0])
+	return nil
+}
+
+func restore(a *storeAdmin, file string, in io.Reader, out io.Writer) error {
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	n, err := server.Restore(a.store, in, *margin, a.namespaces)
+	if err != nil {
+		return fmt.Errorf("imported %d keys, %v", n, err)
+	}
+	fmt.Fprintf(out, "imported %d keys with margin %d\n", n, *margin)
+	return nil
+}
+
+func describe(a admin, key string, out io.Writer) error {
+	info, err := a.Describe(key)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("%s:key does not exist", key)
+	}
+	return printKeys(out, []*server.KeyInfo{info})
+}
+
+func printKeys(out io.Writer, infos []*server.KeyInfo) error {
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+	optional := func(v *int64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.FormatInt(*v, 10)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCURRENT\tSEGMENT_MAX\tHIGH_WATER\tSTEP")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", info.Key, optional(info.Current),
+			optional(info.SegmentMax), info.HighWater, info.Step)
+	}
+	return w.Flush()
+}
+
+// remoteAdmin runs the commands of idgo on a running idgo
+type remoteAdmin struct {
+	client *redis.Client
+}
+
+func newRemoteAdmin() (*remoteAdmin, error) {
+	opt := &redis.Options{
+		Addr:     *addr,
+		Username: *user,
+		Password: *password,
+		DB:       *db,
+		// idgo speaks RESP2 and has no CLIENT command
+		Protocol:        2,
+		DisableIdentity: true,
+	}
+	if len(*tlsCA) != 0 {
+		ca, err := os.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s:no certificate found", *tlsCA)
+		}
+		opt.TLSConfig = &tls.Config{RootCAs: pool}
+		if len(*tlsCert) != 0 {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				return nil, err
+			}
+			opt.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return &remoteAdmin{client: redis.NewClient(opt)}, nil
+}
+
+func (a *remoteAdmin) do(args ...interface{}) *redis.Cmd {
+	return a.client.Do(context.Background(), args...)
+}
+
+func (a *remoteAdmin) Keys(pattern string) ([]string, error) {
+	return a.do("KEYS", pattern).StringSlice()
+}
+
+func (a *remoteAdmin) Describe(key string) (*server.KeyInfo, error) {
+	fields, err := a.do("DESCRIBE", key).StringSlice()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	info := &server.KeyInfo{Key: key}
+	for i := 0; i+1 < len(fields); i += 2 {
+		v, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:invalid %s", fields[i+1], fields[i])
+		}
+		switch fields[i] {
+		case "current":
+			info.Current = &v
+		case "segment_max":
+			info.SegmentMax = &v
+		case "high_water":
+			info.HighWater = v
+		case "step":
+			info.Step = v
+		}
+	}
+	return info, nil
+}
+
+func (a *remoteAdmin) Create(key string, value int64, step int64) error {
+	exist, err := a.do("EXISTS", key).Int64()
+	if err != nil {
+		return err
+	}
+	if exist != 0 {
+		return fmt.Errorf("%s:key exists", key)
+	}
+	args := []interface{}{"SET", key, value}
+	if step != 0 {
+		args = append(args, "STEP", step)
+	}
+	return a.do(args...).Err()
+}
+
+func (a *remoteAdmin) Rebase(key string, value int64) error {
+	return a.do("SET", key, value, "FORCE").Err()
+}
+
+func (a *remoteAdmin) Delete(key string) (bool, error) {
+	n, err := a.do("DEL", key).Int64()
+	return n != 0, err
+}
+
+func (a *remoteAdmin) Close() error {
+	return a.client.Close()
+}
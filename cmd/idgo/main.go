@@ -3,11 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
-	"strings"
 	"syscall"
 
 	"github.com/flike/golog"
@@ -17,6 +17,7 @@ import (
 
 var configFile *string = flag.String("config", "etc/idgo.toml", "idgo config file")
 var logLevel *string = flag.String("log-level", "", "log level [debug|info|warn|error], default error")
+var logFormat *string = flag.String("log-format", "", "log format [logfmt|json], default logfmt")
 
 const (
 	sysLogName = "sys.log"
@@ -32,46 +33,46 @@ func main() {
 		return
 	}
 
-	cfg, err := config.ParseConfigFile(*configFile)
+	cfg, err := loadConfig()
 	if err != nil {
 		fmt.Printf("parse config file error:%v\n", err.Error())
 		return
 	}
 
 	//when the log file size greater than 1GB, kingtask will generate a new file
+	var logFile io.WriteCloser = os.Stdout
 	if len(cfg.LogPath) != 0 {
 		sysFilePath := path.Join(cfg.LogPath, sysLogName)
-		sysFile, err := golog.NewRotatingFileHandler(sysFilePath, MaxLogSize, 1)
+		logFile, err = golog.NewRotatingFileHandler(sysFilePath, MaxLogSize, 1)
 		if err != nil {
 			fmt.Printf("new log file error:%v\n", err.Error())
 			return
 		}
-		golog.GlobalLogger = golog.New(sysFile, golog.Lfile|golog.Ltime|golog.Llevel)
 	}
+	defer logFile.Close()
 
-	if *logLevel != "" {
-		setLogLevel(*logLevel)
-	} else {
-		setLogLevel(cfg.LogLevel)
+	logger, err := server.NewLogger(logFile, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fmt.Printf("new logger error:%v\n", err.Error())
+		return
 	}
+	server.SetLogger(logger)
 
-	var s *server.Server
-	s, err = server.NewServer(cfg)
+	s, err := server.NewServer(cfg)
 	if err != nil {
-		golog.Error("main", "main", err.Error(), 0)
-		golog.GlobalLogger.Close()
-		s.Close()
+		logger.Error("new server error", "err", err)
 		return
 	}
 
 	err = s.Init()
 	if err != nil {
-		golog.Error("main", "main", err.Error(), 0)
-		golog.GlobalLogger.Close()
+		logger.Error("init server error", "err", err)
 		s.Close()
 		return
 	}
 
+	s.SetConfigLoader(loadConfig)
+
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
 		syscall.SIGHUP,
@@ -80,26 +81,33 @@ func main() {
 		syscall.SIGQUIT)
 
 	go func() {
-		sig := <-sc
-		golog.Info("main", "main", "Got signal", 0, "signal", sig)
-		golog.GlobalLogger.Close()
-		s.Close()
+		for sig := range sc {
+			logger.Info("got signal", "signal", sig.String())
+			if sig != syscall.SIGHUP {
+				s.Close()
+				return
+			}
+			// SIGHUP reloads the config, the error keeps the current config
+			if _, err := s.ReloadConfig(); err != nil {
+				logger.Error("reload config error", "err", err)
+			}
+		}
 	}()
-	golog.Info("main", "main", "Idgo start!", 0)
+	logger.Info("idgo start")
 	s.Serve()
 }
 
-func setLogLevel(level string) {
-	switch strings.ToLower(level) {
-	case "debug":
-		golog.GlobalLogger.SetLevel(golog.LevelDebug)
-	case "info":
-		golog.GlobalLogger.SetLevel(golog.LevelInfo)
-	case "warn":
-		golog.GlobalLogger.SetLevel(golog.LevelWarn)
-	case "error":
-		golog.GlobalLogger.SetLevel(golog.LevelError)
-	default:
-		golog.GlobalLogger.SetLevel(golog.LevelError)
+// loadConfig parses the config file, the flags override the config.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.ParseConfigFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	if *logFormat != "" {
+		cfg.LogFormat = *logFormat
 	}
+	return cfg, nil
 }
@@ -7,19 +7,204 @@ import (
 )
 
 type Config struct {
-	Addr           string    `toml:"addr"`
-	LogPath        string    `toml:"log_path"`
-	LogLevel       string    `toml:"log_level"`
-	DatabaseConfig *DBConfig `toml:"storage_db"`
+	Addr             string               `toml:"addr"`
+	LogPath          string               `toml:"log_path"`
+	LogLevel         string               `toml:"log_level"`
+	LogFormat        string               `toml:"log_format"`         // logfmt|json
+	MetricsAddr      string               `toml:"metrics_addr"`       // serve prometheus metrics on http://metrics_addr/metrics
+	HealthAddr       string               `toml:"health_addr"`        // serve the liveness and the readiness on http://health_addr/livez and /readyz
+	KeyCheckInterval int                  `toml:"key_check_interval"` // millisecond between the checks of the generation and the existence of a key, default 1000, negative disables
+	WarmSegments     bool                 `toml:"warm_segments"`      // fetch a segment of every key at startup
+	Namespaces       int                  `toml:"namespaces"`         // the count of namespaces switched by SELECT
+	MaxClients       int                  `toml:"maxclients"`
+	IdleTimeout      int                  `toml:"timeout"`         // second, close the idle connections, 0 is never
+	ReadTimeout      int                  `toml:"read_timeout"`    // second, to read a request after its first byte
+	WriteTimeout     int                  `toml:"write_timeout"`   // second, to write a reply
+	TCPKeepAlive     int                  `toml:"tcp_keepalive"`   // second, default 300, negative disables
+	MaxArgs          int                  `toml:"max_args"`        // the max argument count of a request
+	MaxBulkLength    int                  `toml:"max_bulk_length"` // the max bytes of an argument
+	Batch            int64                `toml:"batch"`           // the count of ids of a segment of the keys without a step, default 2000
+	Storage          string               `toml:"storage"`
+	DatabaseConfig   *DBConfig            `toml:"storage_db"`
+	DatabaseConfigs  []*DBConfig          `toml:"storage_dbs"` // shard keys across several databases
+	Placement        *PlacementConfig     `toml:"placement"`
+	MultiMasters     []*MultiMasterConfig `toml:"multi_master"`
+	Users            []*UserConfig        `toml:"users"`
+	TLS              *TLSConfig           `toml:"tls"`
+	Tracing          *TracingConfig       `toml:"tracing"`
+	Audit            *AuditConfig         `toml:"audit"`
+	SlowLog          *SlowLogConfig       `toml:"slowlog"`
+	RateLimits       []*RateLimitConfig   `toml:"rate_limits"`
+	Quotas           []*QuotaConfig       `toml:"quotas"`
+	Reserves         []*ReserveConfig     `toml:"reserves"`
+	Fetch            *FetchConfig         `toml:"fetch"`
+	EtcdConfig       *EtcdConfig          `toml:"etcd"`
+	RedisConfig      *RedisConfig         `toml:"redis"`
+	SQLiteConfig     *SQLiteConfig        `toml:"sqlite"`
 }
 
+// DBConfig is a MySQL database, DSN of go-sql-driver/mysql overrides the
+// address, the user, the database and the params.
 type DBConfig struct {
-	Host         string `toml:"mysql_host"`
-	Port         int    `toml:"mysql_port"`
-	User         string `toml:"user"`
-	Password     string `toml:"password"`
-	DBName       string `toml:"db_name"`
-	MaxIdleConns int    `toml:"max_idle_conns"`
+	Name            string            `toml:"name"`
+	DSN             string            `toml:"dsn"`
+	Host            string            `toml:"mysql_host"`
+	Port            int               `toml:"mysql_port"`
+	Socket          string            `toml:"mysql_socket"` // the unix socket instead of mysql_host and mysql_port
+	User            string            `toml:"user"`
+	Password        string            `toml:"password"`
+	DBName          string            `toml:"db_name"`
+	Charset         string            `toml:"charset"`         // default utf8
+	Params          map[string]string `toml:"params"`          // the extra params of the connection
+	ConnectTimeout  int               `toml:"connect_timeout"` // millisecond, default 5000
+	ReadTimeout     int               `toml:"read_timeout"`    // millisecond, default 10000
+	WriteTimeout    int               `toml:"write_timeout"`   // millisecond, default 10000
+	MaxIdleConns    int               `toml:"max_idle_conns"`
+	MaxOpenConns    int               `toml:"max_open_conns"`     // 0 is unlimited
+	ConnMaxLifetime int               `toml:"conn_max_lifetime"`  // second, 0 is unlimited
+	ConnMaxIdleTime int               `toml:"conn_max_idle_time"` // second, 0 is unlimited
+	TLS             string            `toml:"tls"`                // false|true|skip-verify|preferred
+	TLSCAFile       string            `toml:"tls_ca_file"`
+	TLSCertFile     string            `toml:"tls_cert_file"`
+	TLSKeyFile      string            `toml:"tls_key_file"`
+}
+
+// PlacementConfig places every key on one of the storage_dbs.
+// Policy "hash" places keys by consistent hash of the key,
+// policy "map" places keys by Keys(key -> db name) and the others on Default.
+type PlacementConfig struct {
+	Policy  string            `toml:"policy"`
+	Keys    map[string]string `toml:"keys"`
+	Default string            `toml:"default"`
+}
+
+// MultiMasterConfig lets several independent databases issue ids of the
+// same keys, every database only issues the segments whose index modulo
+// stride equals its offset.
+type MultiMasterConfig struct {
+	Keys  []string          `toml:"keys"`
+	Batch int64             `toml:"batch"`
+	DBs   []*MasterDBConfig `toml:"dbs"`
+}
+
+type MasterDBConfig struct {
+	DBConfig
+	Offset int64 `toml:"offset"`
+	Stride int64 `toml:"stride"`
+}
+
+// UserConfig is a user of AUTH, Commands are the command classes
+// (read|allocate|admin) the user can run, Keys are the key globs the
+// user can access. The user named "default" without password is the
+// user of the connections not authenticated.
+type UserConfig struct {
+	Name     string   `toml:"name"`
+	Password string   `toml:"password"`
+	Commands []string `toml:"commands"`
+	Keys     []string `toml:"keys"`
+	// the namespaces the user can SELECT and access, all if it is empty
+	Namespaces []int  `toml:"namespaces"`
+	CertCN     string `toml:"cert_cn"` // authenticate the client certificate with this common name
+}
+
+// TLSConfig enables TLS on the client listener. ClientAuth is one of
+// none|request|require, the client certificates are verified by CAFile.
+// The files are checked every ReloadInterval seconds and reloaded when changed.
+type TLSConfig struct {
+	CertFile       string `toml:"cert_file"`
+	KeyFile        string `toml:"key_file"`
+	CAFile         string `toml:"ca_file"`
+	ClientAuth     string `toml:"client_auth"`
+	ReloadInterval int    `toml:"reload_interval"`
+}
+
+// TracingConfig exports the OpenTelemetry spans, Exporter is one of
+// none|otlp, the spans are exported to the OTLP gRPC Endpoint.
+type TracingConfig struct {
+	Exporter    string  `toml:"exporter"`
+	Endpoint    string  `toml:"endpoint"`
+	Insecure    bool    `toml:"insecure"`
+	ServiceName string  `toml:"service_name"`
+	SampleRatio float64 `toml:"sample_ratio"`
+}
+
+// RateLimitConfig limits every client identity matching the glob Client,
+// or every key matching the glob Key, by a token bucket of Rate requests per
+// second and Burst. The identity of a client is the authenticated user name,
+// or the ip of the client.
+type RateLimitConfig struct {
+	Client string  `toml:"client"`
+	Key    string  `toml:"key"`
+	Rate   float64 `toml:"rate"`
+	Burst  int     `toml:"burst"`
+}
+
+// QuotaConfig limits the ids issued per day and per month of every key
+// matching the glob Key, 0 is unlimited.
+type QuotaConfig struct {
+	Key     string `toml:"key"`
+	Daily   int64  `toml:"daily"`
+	Monthly int64  `toml:"monthly"`
+}
+
+// ReserveConfig keeps Size ids of every key matching the glob Key in
+// reserve, the reserve is only issued while the storage is unavailable.
+type ReserveConfig struct {
+	Key  string `toml:"key"`
+	Size int64  `toml:"size"`
+}
+
+// FetchConfig is the retries, the timeout and the circuit breaker of the
+// segment fetches. A fetch failed with a retryable error is retried up to
+// Retries times after a jittered backoff from Backoff to MaxBackoff. The
+// breaker opens after BreakerFailures failed attempts in a row, and lets a
+// fetch try again after BreakerCooldown.
+type FetchConfig struct {
+	Retries         int `toml:"retries"`          // default 2, negative disables the retries
+	Backoff         int `toml:"backoff"`          // millisecond, default 50
+	MaxBackoff      int `toml:"max_backoff"`      // millisecond, default 1000
+	Timeout         int `toml:"timeout"`          // millisecond of every fetch transaction, default 3000
+	BreakerFailures int `toml:"breaker_failures"` // default 5, negative disables the breaker
+	BreakerCooldown int `toml:"breaker_cooldown"` // millisecond, default 5000
+}
+
+// SlowLogConfig keeps the latest MaxLen requests slower than LogSlowerThan
+// microseconds. Like redis, 0 logs every request and a negative
+// LogSlowerThan disables the slow log, the default is used if it is not set.
+type SlowLogConfig struct {
+	LogSlowerThan *int64 `toml:"log_slower_than"`
+	MaxLen        int    `toml:"max_len"`
+}
+
+// AuditConfig records SET and DEL to the audit table of the storage
+// database, and to the rotating file of Path if it is set.
+type AuditConfig struct {
+	Path    string `toml:"path"`
+	MaxSize int    `toml:"max_size"` // MB
+	Backups int    `toml:"backups"`
+}
+
+type EtcdConfig struct {
+	Endpoints      []string `toml:"endpoints"`
+	Prefix         string   `toml:"prefix"`
+	User           string   `toml:"user"`
+	Password       string   `toml:"password"`
+	DialTimeout    int      `toml:"dial_timeout"`    // millisecond
+	RequestTimeout int      `toml:"request_timeout"` // millisecond
+}
+
+type RedisConfig struct {
+	Addr     string `toml:"addr"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	Prefix   string `toml:"prefix"`
+	Timeout  int    `toml:"timeout"` // millisecond
+}
+
+type SQLiteConfig struct {
+	Path        string `toml:"path"`
+	BusyTimeout int    `toml:"busy_timeout"` // millisecond
 }
 
 func ParseConfigFile(fileName string) (*Config, error) {
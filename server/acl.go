@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultUserName = "default"
+
+	// command classes
+	CommandClassRead     = "read"
+	CommandClassAllocate = "allocate"
+	CommandClassAdmin    = "admin"
+)
+
+// the command class and whether the first argument is a key
+var commandClasses = map[string]struct {
+	class  string
+	hasKey bool
+}{
+	"GET":      {CommandClassAllocate, true},
+	"EXISTS":   {CommandClassRead, true},
+	"SET":      {CommandClassAdmin, true},
+	"DEL":      {CommandClassAdmin, true},
+	"AUDIT":    {CommandClassAdmin, false},
+	"SLOWLOG":  {CommandClassAdmin, false},
+	"MONITOR":  {CommandClassAdmin, false},
+	"INFO":     {CommandClassRead, false},
+	"KEYS":     {CommandClassRead, false},
+	"DESCRIBE": {CommandClassRead, true},
+	"CONFIG":   {CommandClassAdmin, false},
+}
+
+type User struct {
+	Name     string
+	certCN   string
+	nopass   bool // the user is authenticated without password
+	hasPass  bool
+	password [sha256.Size]byte // sha256 of the password
+	classes  map[string]bool
+	keys     []string // key globs
+
+	namespaces map[int]bool // nil if the user can access all namespaces
+}
+
+func newUser(c *config.UserConfig) (*User, error) {
+	if len(c.Name) == 0 {
+		return nil, fmt.Errorf("user:have no name")
+	}
+	u := &User{
+		Name:    c.Name,
+		certCN:  c.CertCN,
+		nopass:  len(c.Password) == 0 && len(c.CertCN) == 0,
+		hasPass: len(c.Password) != 0,
+		classes: make(map[string]bool),
+		keys:    c.Keys,
+	}
+	u.password = sha256.Sum256([]byte(c.Password))
+	for _, class := range c.Commands {
+		switch class {
+		case CommandClassRead, CommandClassAllocate, CommandClassAdmin:
+			u.classes[class] = true
+		default:
+			return nil, fmt.Errorf("user %s:%s:invalid command class", c.Name, class)
+		}
+	}
+	for _, glob := range c.Keys {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("user %s:%s:invalid key glob", c.Name, glob)
+		}
+	}
+	if len(c.Namespaces) != 0 {
+		u.namespaces = make(map[int]bool)
+		for _, ns := range c.Namespaces {
+			if ns < 0 {
+				return nil, fmt.Errorf("user %s:%d:invalid namespace", c.Name, ns)
+			}
+			u.namespaces[ns] = true
+		}
+	}
+	return u, nil
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	if !u.hasPass {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], u.password[:]) == 1
+}
+
+// CanAccess checks the user can run the command class on key,
+// key is ignored if it is empty.
+func (u *User) CanAccess(class string, key string) bool {
+	if !u.classes[class] {
+		return false
+	}
+	if len(key) == 0 {
+		return true
+	}
+	for _, glob := range u.keys {
+		if ok, _ := path.Match(glob, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CanUseNamespace checks the user can select and access namespace ns
+func (u *User) CanUseNamespace(ns int) bool {
+	return u.namespaces == nil || u.namespaces[ns]
+}
+
+// String describes the user like the redis ACL LIST
+func (u *User) String() string {
+	parts := []string{"user", u.Name, "on"}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	if u.hasPass {
+		parts = append(parts, "#"+hex.EncodeToString(u.password[:]))
+	}
+	if len(u.certCN) != 0 {
+		parts = append(parts, "cert_cn="+u.certCN)
+	}
+	for _, class := range []string{CommandClassRead, CommandClassAllocate, CommandClassAdmin} {
+		if u.classes[class] {
+			parts = append(parts, "+@"+class)
+		}
+	}
+	for _, glob := range u.keys {
+		parts = append(parts, "~"+glob)
+	}
+	if u.namespaces != nil {
+		namespaces := make([]int, 0, len(u.namespaces))
+		for ns := range u.namespaces {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Ints(namespaces)
+		for _, ns := range namespaces {
+			parts = append(parts, "db"+strconv.Itoa(ns))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ACL authenticates the users and checks their permissions.
+type ACL struct {
+	users map[string]*User
+	names []string
+}
+
+// NewACL creates the ACL of users, it returns nil if there is no user
+// which means every connection can run all the commands.
+func NewACL(users []*config.UserConfig) (*ACL, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	a := &ACL{
+		users: make(map[string]*User),
+	}
+	for _, c := range users {
+		u, err := newUser(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, fmt.Errorf("user %s:duplicate user", u.Name)
+		}
+		a.users[u.Name] = u
+		a.names = append(a.names, u.Name)
+	}
+	return a, nil
+}
+
+// Authenticate returns the user if the password matches.
+func (a *ACL) Authenticate(name string, password string) (*User, bool) {
+	u, ok := a.users[name]
+	if !ok || !u.checkPassword(password) {
+		return nil, false
+	}
+	return u, true
+}
+
+// DefaultUser returns the user of the connections not authenticated,
+// it is the default user without password.
+func (a *ACL) DefaultUser() *User {
+	u, ok := a.users[DefaultUserName]
+	if !ok || !u.nopass {
+		return nil
+	}
+	return u
+}
+
+// CertUser returns the user of the client certificate common name.
+func (a *ACL) CertUser(cn string) *User {
+	for _, name := range a.names {
+		if u := a.users[name]; len(u.certCN) != 0 && u.certCN == cn {
+			return u
+		}
+	}
+	return nil
+}
+
+func (a *ACL) Users() []*User {
+	users := make([]*User, 0, len(a.names))
+	for _, name := range a.names {
+		users = append(users, a.users[name])
+	}
+	return users
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flike/idgo/config"
+)
+
+func newTestACLServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	acl, err := NewACL([]*config.UserConfig{
+		{Name: "admin", Password: "secret", Commands: []string{"read", "allocate", "admin"}, Keys: []string{"*"}},
+		{Name: "order", Password: "pass", Commands: []string{"read", "allocate"}, Keys: []string{"order*"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.acl = acl
+	return s
+}
+
+func TestACL(t *testing.T) {
+	s := newTestACLServer(t)
+	c := &Client{}
+	do := func(command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		return replyString(t, s.ServeRequest(r))
+	}
+
+	if got := do("GET", "order_id"); got != "-ERR authentication required\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("AUTH", "secret"); got != "-ERR invalid username-password pair\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("AUTH", "admin", "wrong"); got != "-ERR invalid username-password pair\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("AUTH", "admin", "secret"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("SET", "order_id", "10"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("SET", "user_id", "10"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("ACL", "LIST"); !strings.Contains(got, "user order on #") || strings.Contains(got, "pass\r\n") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	if got := do("AUTH", "order", "pass"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("ACL", "WHOAMI"); got != "$5\r\norder\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("GET", "order_id"); got != "$2\r\n11\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("EXISTS", "order_id"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	for _, r := range [][]string{
+		{"GET", "user_id"},
+		{"DEL", "order_id"},
+		{"SET", "order_id", "1"},
+	} {
+		if got := do(r[0], r[1:]...); !strings.HasPrefix(got, "-ERR user order has no permission") {
+			t.Fatalf("%v: unexpected reply %q", r, got)
+		}
+	}
+	if got := do("ACL", "LIST"); got != "-ERR no permission to run the command\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestACLDefaultUser(t *testing.T) {
+	acl, err := NewACL([]*config.UserConfig{
+		{Name: "default", Commands: []string{"read"}, Keys: []string{"*"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	u := acl.DefaultUser()
+	if u == nil {
+		t.Fatal("default user without password should be used")
+	}
+	if !u.CanAccess(CommandClassRead, "abc") || u.CanAccess(CommandClassAllocate, "abc") {
+		t.Fatal("unexpected permission of default user")
+	}
+
+	if _, err = NewACL([]*config.UserConfig{{Name: "a", Commands: []string{"write"}}}); err == nil {
+		t.Fatal("invalid command class should fail")
+	}
+	if acl, _ = NewACL(nil); acl != nil {
+		t.Fatal("acl should be disabled without users")
+	}
+}
+
+func TestACLNamespaces(t *testing.T) {
+	s := newTestServer(t)
+	acl, err := NewACL([]*config.UserConfig{
+		{Name: "tenant", Password: "pass", Commands: []string{"read", "allocate", "admin"}, Keys: []string{"*"}, Namespaces: []int{1}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.acl = acl
+	c := &Client{}
+	do := func(command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		return replyString(t, s.ServeRequest(r))
+	}
+
+	if got := do("AUTH", "tenant", "pass"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// the connection starts in namespace 0 which the user can not access
+	if got := do("GET", "order_id"); got != "-ERR user tenant has no permission to access namespace 0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("SELECT", "1"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("SET", "order_id", "10"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("SELECT", "2"); got != "-ERR user tenant has no permission to access namespace 2\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if c.Namespace != 1 {
+		t.Fatalf("expect namespace 1, got %d", c.Namespace)
+	}
+	if got := do("ACL", "LIST"); !strings.Contains(got, " db1") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	if _, err = NewACL([]*config.UserConfig{{Name: "a", Commands: []string{"read"}, Namespaces: []int{-1}}}); err == nil {
+		t.Fatal("invalid namespace should fail")
+	}
+}
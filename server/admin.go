@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// KeyInfo is the state of a key, Current and SegmentMax are only known by
+// a running idgo which has loaded the key.
+type KeyInfo struct {
+	Key        string `json:"key"`
+	Current    *int64 `json:"current,omitempty"`     // the last id issued
+	SegmentMax *int64 `json:"segment_max,omitempty"` // the max id of the cached segment
+	HighWater  int64  `json:"high_water"`            // the high-water mark in the storage
+	Step       int64  `json:"step"`                  // the count of ids of a segment
+}
+
+// StoreAdmin manages the keys of a namespace in the storage directly, the
+// running idgo servers find the changes by the generation of the key.
+type StoreAdmin struct {
+	store SegmentStore
+	ns    int
+}
+
+// NewStoreAdmin manages the keys of namespace ns, namespaces is the count of
+// namespaces configured, 0 is the default.
+func NewStoreAdmin(store SegmentStore, ns int, namespaces int) (*StoreAdmin, error) {
+	if ns < 0 || ns >= namespaceCount(namespaces) {
+		return nil, fmt.Errorf("%d:namespace is out of range", ns)
+	}
+	return &StoreAdmin{store: store, ns: ns}, nil
+}
+
+func (a *StoreAdmin) storeKey(key string) (string, error) {
+	if !IsValidKey(key) {
+		return "", fmt.Errorf("%s:invalid key", key)
+	}
+	return namespaceKey(a.ns, key), nil
+}
+
+// Keys returns the sorted keys of the namespace matching the glob pattern
+func (a *StoreAdmin) Keys(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	storeKeys, err := a.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(storeKeys))
+	for _, storeKey := range storeKeys {
+		ns, key, ok := splitNamespace(storeKey)
+		if !ok || ns != a.ns {
+			continue
+		}
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Describe returns the state of key, nil if the key does not exist
+func (a *StoreAdmin) Describe(key string) (*KeyInfo, error) {
+	storeKey, err := a.storeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	exist, err := a.store.IsKeyExist(storeKey)
+	if err != nil || !exist {
+		return nil, err
+	}
+	info := &KeyInfo{Key: key}
+	if info.HighWater, err = a.store.Current(storeKey); err != nil {
+		return nil, err
+	}
+	if info.Step, err = keyStep(a.store, storeKey); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// keyStep returns the count of ids of a segment of key in store
+func keyStep(store SegmentStore, key string) (int64, error) {
+	if b, ok := store.(BatchSizer); ok && b.BatchSize(key) != 0 {
+		return b.BatchSize(key), nil
+	}
+	if st, ok := store.(StepStore); ok {
+		step, err := st.Step(key)
+		if err != nil || step > 0 {
+			return step, err
+		}
+	}
+	return BatchCount, nil
+}
+
+// explicitStep returns the step set for key in store, 0 if the key has no
+// step and uses the default batch.
+func explicitStep(store SegmentStore, key string) (int64, error) {
+	if st, ok := store.(StepStore); ok {
+		return st.Step(key)
+	}
+	return 0, nil
+}
+
+// Create creates key with value, step is the count of ids of a segment,
+// 0 is the default step.
+func (a *StoreAdmin) Create(key string, value int64, step int64) error {
+	storeKey, err := a.storeKey(key)
+	if err != nil {
+		return err
+	}
+	if step < 0 || step > MaxStep {
+		return fmt.Errorf("%d:step is out of range", step)
+	}
+	exist, err := a.store.IsKeyExist(storeKey)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return fmt.Errorf("%s:key exists", key)
+	}
+	var st StepStore
+	if step != 0 {
+		var ok bool
+		st, ok = a.store.(StepStore)
+		if b, fixed := a.store.(BatchSizer); !ok || (fixed && b.BatchSize(storeKey) != 0) {
+			return fmt.Errorf("%s:the step of the key can not be set", key)
+		}
+	}
+	if _, err := a.store.Reset(storeKey, value, false); err != nil {
+		return err
+	}
+	if st != nil {
+		return st.SetStep(storeKey, step)
+	}
+	return nil
+}
+
+// Rebase sets the value of an existing key
+func (a *StoreAdmin) Rebase(key string, value int64) error {
+	storeKey, err := a.storeKey(key)
+	if err != nil {
+		return err
+	}
+	exist, err := a.store.IsKeyExist(storeKey)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return fmt.Errorf("%s:key does not exist", key)
+	}
+	if _, err = a.store.Reset(storeKey, value, true); err != nil {
+		return err
+	}
+	return bumpGeneration(a.store, storeKey)
+}
+
+// Delete removes key and its step, it returns false if the key does not exist
+func (a *StoreAdmin) Delete(key string) (bool, error) {
+	storeKey, err := a.storeKey(key)
+	if err != nil {
+		return false, err
+	}
+	exist, err := a.store.IsKeyExist(storeKey)
+	if err != nil || !exist {
+		return false, err
+	}
+	if err := a.store.Delete(storeKey); err != nil {
+		return false, err
+	}
+	if err := bumpGeneration(a.store, storeKey); err != nil {
+		return false, err
+	}
+	if st, ok := a.store.(StepStore); ok {
+		if err := st.SetStep(storeKey, 0); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestStoreAdmin(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	if _, err := NewStoreAdmin(store, DefaultNamespaces, 0); err == nil {
+		t.Fatal("expect error of namespace out of range")
+	}
+	if _, err := NewStoreAdmin(store, 4, 4); err == nil {
+		t.Fatal("expect error of namespace out of configured range")
+	}
+	if _, err := NewStoreAdmin(store, 20, 32); err != nil {
+		t.Fatal(err.Error())
+	}
+	a, err := NewStoreAdmin(store, 1, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := a.Create("order", 100, 50); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := a.Create("order", 1, 0); err == nil {
+		t.Fatal("expect error of existing key")
+	}
+	if err := a.Create("a b", 1, 0); err == nil {
+		t.Fatal("expect error of invalid key")
+	}
+	a.Create("user", 1, 0)
+	store.Reset("other", 1, false)
+
+	keys, err := a.Keys("*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 2 || keys[0] != "order" || keys[1] != "user" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	info, err := a.Describe("order")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.HighWater != 100 || info.Step != 50 || info.Current != nil {
+		t.Fatalf("unexpected key %+v", info)
+	}
+	if info, _ := a.Describe("user"); info.Step != BatchCount {
+		t.Fatalf("unexpected key %+v", info)
+	}
+
+	if err := a.Rebase("order", 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, _ := store.Current("__1__order"); id != 10 {
+		t.Fatalf("expect 10, got %d", id)
+	}
+	if err := a.Rebase("none", 10); err == nil {
+		t.Fatal("expect error of missing key")
+	}
+
+	if deleted, err := a.Delete("order"); !deleted || err != nil {
+		t.Fatalf("expect deleted, got %v %v", deleted, err)
+	}
+	if info, err := a.Describe("order"); info != nil || err != nil {
+		t.Fatalf("expect no key, got %+v %v", info, err)
+	}
+	if step, _ := store.(StepStore).Step("__1__order"); step != 0 {
+		t.Fatalf("expect no step, got %d", step)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flike/golog"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	AuditTableName        = "__idgo_audit__"
+	DefaultAuditMaxSize   = 1024 // MB
+	DefaultAuditBackups   = 10
+	DefaultAuditGetCount  = 10
+	MaxAuditGetCount      = 1000
+	maxAuditMessageLength = 1024
+	// MaxStoredAuditEntries is the number of the latest entries kept by
+	// the redis and etcd storage in every namespace.
+	MaxStoredAuditEntries = 10000
+)
+
+var errNoAuditTable = errors.New("audit:the storage backend does not support audit")
+
+// AuditEntry is a record of an administrative operation on a key, the old
+// value is nil if the key did not exist and the new value is nil if the
+// key is deleted.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Client    string    `json:"client"`
+	Command   string    `json:"command"`
+	Namespace int       `json:"namespace"`
+	Key       string    `json:"key"`
+	OldValue  *int64    `json:"old_value"`
+	NewValue  *int64    `json:"new_value"`
+	Err       string    `json:"err,omitempty"`
+}
+
+// AuditStore is implemented by the stores which keep the audit entries,
+// the sql stores in a table, redis in lists and etcd under a prefix.
+type AuditStore interface {
+	InitAudit() error
+	AppendAudit(e *AuditEntry) error
+	// AuditEntries returns the latest count entries of the key in namespace
+	// ns, or the entries of all keys in ns if key is empty.
+	AuditEntries(ns int, key string, count int) ([]*AuditEntry, error)
+}
+
+// Auditor appends the audit entries to a rotating file and to the
+// storage.
+type Auditor struct {
+	lock  sync.Mutex
+	file  io.WriteCloser
+	store AuditStore
+}
+
+func newAuditor(c *config.AuditConfig, store SegmentStore) (*Auditor, error) {
+	a := new(Auditor)
+	if s, ok := store.(AuditStore); ok {
+		err := s.InitAudit()
+		switch {
+		case err == errNoAuditTable:
+			logger.Warn("storage backend does not support audit, audit entries are only written to the file")
+		case err != nil:
+			return nil, err
+		default:
+			a.store = s
+		}
+	}
+	if len(c.Path) != 0 {
+		maxSize := c.MaxSize
+		if maxSize <= 0 {
+			maxSize = DefaultAuditMaxSize
+		}
+		backups := c.Backups
+		if backups <= 0 {
+			backups = DefaultAuditBackups
+		}
+		f, err := golog.NewRotatingFileHandler(c.Path, maxSize*1024*1024, backups)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// Record appends e to the file and to the storage, the failures are
+// logged and do not fail the operation.
+func (a *Auditor) Record(e *AuditEntry) {
+	if len(e.Err) > maxAuditMessageLength {
+		e.Err = e.Err[:maxAuditMessageLength]
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.store != nil {
+		if err := a.store.AppendAudit(e); err != nil {
+			logger.Error("append audit entry error",
+				"key", e.Key,
+				"err", err,
+			)
+		}
+	}
+	if a.file != nil {
+		data, _ := json.Marshal(e)
+		if _, err := a.file.Write(append(data, '\n')); err != nil {
+			logger.Error("write audit file error",
+				"key", e.Key,
+				"err", err,
+			)
+		}
+	}
+}
+
+// Entries returns the latest entries from the storage.
+func (a *Auditor) Entries(ns int, key string, count int) ([]*AuditEntry, error) {
+	if a.store == nil {
+		return nil, errNoAuditTable
+	}
+	return a.store.AuditEntries(ns, key, count)
+}
+
+func (a *Auditor) Close() error {
+	if a.file != nil {
+		return a.file.Close()
+	}
+	return nil
+}
+
+// auditValue returns the persisted value of key, nil if the key is not
+// existed or the value can not be read.
+func auditValue(store SegmentStore, key string) *int64 {
+	if ok, err := store.IsKeyExist(key); err != nil || !ok {
+		return nil
+	}
+	v, err := store.Current(key)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// scanAuditEntries scans the rows of the audit table of the sql stores
+func scanAuditEntries(rows *sql.Rows) ([]*AuditEntry, error) {
+	defer rows.Close()
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		var (
+			e        AuditEntry
+			ts       int64
+			oldValue sql.NullInt64
+			newValue sql.NullInt64
+		)
+		err := rows.Scan(&e.ID, &ts, &e.User, &e.Client, &e.Command, &e.Namespace, &e.Key, &oldValue, &newValue, &e.Err)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = time.UnixMilli(ts)
+		if oldValue.Valid {
+			e.OldValue = &oldValue.Int64
+		}
+		if newValue.Valid {
+			e.NewValue = &newValue.Int64
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// auditArgs returns the values of the audit table columns except id
+func auditArgs(e *AuditEntry) []interface{} {
+	var oldValue, newValue sql.NullInt64
+	if e.OldValue != nil {
+		oldValue = sql.NullInt64{Int64: *e.OldValue, Valid: true}
+	}
+	if e.NewValue != nil {
+		newValue = sql.NullInt64{Int64: *e.NewValue, Valid: true}
+	}
+	return []interface{}{e.Time.UnixMilli(), e.User, e.Client, e.Command, e.Namespace, e.Key, oldValue, newValue, e.Err}
+}
+
+// queryAuditEntries runs the select of the audit table of the sql stores
+func queryAuditEntries(db *sql.DB, selectAll string, selectKey string, ns int, key string, count int) ([]*AuditEntry, error) {
+	var rows *sql.Rows
+	var err error
+	if len(key) == 0 {
+		rows, err = db.Query(selectAll, ns, count)
+	} else {
+		rows, err = db.Query(selectKey, ns, key, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEntries(rows)
+}
+
+func (s *ShardStore) InitAudit() error {
+	found := false
+	for _, name := range s.names {
+		a, ok := s.shards[name].(AuditStore)
+		if !ok {
+			continue
+		}
+		err := a.InitAudit()
+		if err == errNoAuditTable {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("shard %s:%v", name, err)
+		}
+		found = true
+	}
+	if !found {
+		return errNoAuditTable
+	}
+	return nil
+}
+
+// AppendAudit appends e to the shard which the key is placed on, the
+// entry is dropped if the shard does not support audit.
+func (s *ShardStore) AppendAudit(e *AuditEntry) error {
+	if a, ok := s.shard(namespaceKey(e.Namespace, e.Key)).(AuditStore); ok {
+		return a.AppendAudit(e)
+	}
+	return nil
+}
+
+func (s *ShardStore) AuditEntries(ns int, key string, count int) ([]*AuditEntry, error) {
+	if len(key) != 0 {
+		if a, ok := s.shard(namespaceKey(ns, key)).(AuditStore); ok {
+			return a.AuditEntries(ns, key, count)
+		}
+		return []*AuditEntry{}, nil
+	}
+
+	entries := make([]*AuditEntry, 0)
+	for _, name := range s.names {
+		a, ok := s.shards[name].(AuditStore)
+		if !ok {
+			continue
+		}
+		shardEntries, err := a.AuditEntries(ns, key, count)
+		if err == errNoAuditTable {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shard %s:%v", name, err)
+		}
+		entries = append(entries, shardEntries...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
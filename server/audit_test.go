@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestAudit(t *testing.T) {
+	s := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditor(&config.AuditConfig{Path: path}, s.store)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.audit = audit
+	defer audit.Close()
+
+	c := &Client{RemoteAddress: "127.0.0.1:5000"}
+	do := func(command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		r.RemoteAddress = c.RemoteAddress
+		return replyString(t, s.ServeRequest(r))
+	}
+	do("SET", "audit_key", "100")
+	do("GET", "audit_key")
+	do("SET", "audit_key", "200")
+	do("SET", "other_key", "1")
+	do("DEL", "audit_key")
+
+	entries, err := audit.Entries(0, "audit_key", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expect 3 entries, got %d", len(entries))
+	}
+	// the first SET creates the key, the second keeps the existing value
+	if e := entries[2]; e.Command != "SET" || e.OldValue != nil || *e.NewValue != 100 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; *e.OldValue != 2100 || *e.NewValue != 2100 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := entries[0]; e.Command != "DEL" || *e.OldValue != 2100 || e.NewValue != nil {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// id, time, user, client, command, namespace, key, old value, new value, error
+	got := do("AUDIT", "GET", "10", "audit_key")
+	if want := "*3\r\n" +
+		"*10\r\n:4\r\n:" + strconv.FormatInt(entries[0].Time.Unix(), 10) + "\r\n$-1\r\n$14\r\n127.0.0.1:5000\r\n$3\r\nDEL\r\n:0\r\n$9\r\naudit_key\r\n$4\r\n2100\r\n$-1\r\n$-1\r\n"; !strings.HasPrefix(got, want) {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	if got := do("AUDIT", "GET", "2"); !strings.HasPrefix(got, "*2\r\n") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// the entries of other namespaces are not listed
+	do("SELECT", "1")
+	if got := do("AUDIT", "GET", "10"); got != "*0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("AUDIT", "GET", "0"); got != "-ERR count is out of range\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	var lines []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			t.Fatal(err.Error())
+		}
+		lines = append(lines, e)
+	}
+	if len(lines) != 4 || lines[3].Command != "DEL" || lines[3].Key != "audit_key" || lines[3].Client != "127.0.0.1:5000" {
+		t.Fatalf("unexpected audit file %+v", lines)
+	}
+}
+
+func TestAuditNotEnabled(t *testing.T) {
+	s := newTestServer(t)
+	got := replyString(t, s.ServeRequest(newTestRequest("AUDIT", "GET")))
+	if got != "-ERR audit is not enabled\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+// testAuditStore checks the audit entries of the stores which keep them
+// outside a sql table.
+func testAuditStore(t *testing.T, store AuditStore) {
+	if err := store.InitAudit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now()
+	appendEntry := func(ns int, key string, value int64) *AuditEntry {
+		e := &AuditEntry{Time: now, Command: "SET", Namespace: ns, Key: key, NewValue: &value}
+		if err := store.AppendAudit(e); err != nil {
+			t.Fatal(err.Error())
+		}
+		return e
+	}
+	first := appendEntry(0, "order", 1)
+	appendEntry(0, "order_2", 2)
+	appendEntry(1, "order", 3)
+	last := appendEntry(0, "order", 4)
+	if first.ID == 0 || last.ID <= first.ID {
+		t.Fatalf("unexpected ids %d %d", first.ID, last.ID)
+	}
+
+	entries, err := store.AuditEntries(0, "order", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 || *entries[0].NewValue != 4 || *entries[1].NewValue != 1 || entries[0].ID != last.ID {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries, err = store.AuditEntries(0, "", 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 || entries[0].Key != "order" || entries[1].Key != "order_2" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries, err = store.AuditEntries(1, "", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 1 || *entries[0].NewValue != 3 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries, err = store.AuditEntries(2, "order", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
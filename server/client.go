@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+)
+
+// Client is the state of a client connection shared by its requests.
+type Client struct {
+	ID            uint64
+	RemoteAddress string
+	// the subject of the verified client certificate
+	CertSubject string
+	// the authenticated user, nil if the connection is not authenticated
+	User *User
+	// the namespace switched by SELECT
+	Namespace int
+	// the connection issued MONITOR
+	Monitoring bool
+
+	log *slog.Logger
+}
+
+func newClient(conn net.Conn, acl *ACL) *Client {
+	c := &Client{
+		ID:            connIDs.Add(1),
+		RemoteAddress: conn.RemoteAddr().String(),
+	}
+	c.log = logger.With("conn_id", c.ID, "client", c.RemoteAddress)
+	if acl != nil {
+		c.User = acl.DefaultUser()
+	}
+	return c
+}
+
+// setCertificate authenticates the user of the verified client certificate
+func (c *Client) setCertificate(conn *tls.Conn, acl *ACL) {
+	var cn string
+	c.CertSubject, cn = peerSubject(conn)
+	if acl == nil || len(cn) == 0 {
+		return
+	}
+	if u := acl.CertUser(cn); u != nil {
+		c.User = u
+	}
+}
+
+func (c *Client) UserName() string {
+	if c.User == nil {
+		return ""
+	}
+	return c.User.Name
+}
@@ -1,10 +1,15 @@
 package server
 
-import "strconv"
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func (s *Server) handleGet(r *Request) Reply {
-	var idgen *MySQLIdGenerator
-	var ok bool
+	var idgen *IdGenerator
 	var id int64
 	var err error
 
@@ -16,19 +21,42 @@ func (s *Server) handleGet(r *Request) Reply {
 	if len(idGenKey) == 0 {
 		return ErrNoKey
 	}
-	s.Lock()
-	idgen, ok = s.keyGeneratorMap[idGenKey]
-
-	if ok == false {
-		s.Unlock()
+	if !IsValidKey(idGenKey) {
+		return ErrInvalidKey
+	}
+	idGenKey = namespaceKey(r.Namespace(), idGenKey)
+	idgen, err = s.lookupKey(idGenKey)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	if idgen == nil {
 		return &BulkReply{
 			value: nil,
 		}
 	}
 
-	s.Unlock()
-	id, err = idgen.Next()
+	limiter := s.currentLimiter()
+	if limiter != nil {
+		if errReply := limiter.AllowKey(string(r.Arguments[0]), idGenKey); errReply != nil {
+			return errReply
+		}
+	}
+	id, err = idgen.NextContext(r.Context())
 	if err != nil {
+		if limiter != nil {
+			limiter.Release(idGenKey)
+		}
+		// the key is deleted by another instance
+		if !isUnavailable(err) {
+			if exist, e := s.store.IsKeyExist(idGenKey); e == nil && !exist {
+				s.forgetKey(idGenKey, idgen)
+				return &BulkReply{
+					value: nil,
+				}
+			}
+		}
 		return &ErrorReply{
 			message: err.Error(),
 		}
@@ -40,9 +68,11 @@ func (s *Server) handleGet(r *Request) Reply {
 	}
 }
 
-// redis command(set abc 12)
+// redis command(set abc 12), or (set abc 12 step 5000 force),
+// STEP sets the count of ids of a segment and FORCE overwrites the
+// existing value.
 func (s *Server) handleSet(r *Request) Reply {
-	var idgen *MySQLIdGenerator
+	var idgen *IdGenerator
 	var ok bool
 	var err error
 
@@ -54,14 +84,43 @@ func (s *Server) handleSet(r *Request) Reply {
 	if len(idGenKey) == 0 {
 		return ErrNoKey
 	}
+	if !IsValidKey(idGenKey) {
+		return ErrInvalidKey
+	}
+	idGenKey = namespaceKey(r.Namespace(), idGenKey)
 	idValue, errReply := r.GetInt(1)
 	if errReply != nil {
 		return errReply
 	}
+	var step int64
+	force := false
+	for i := 2; i < len(r.Arguments); i++ {
+		switch strings.ToUpper(string(r.Arguments[i])) {
+		case "STEP":
+			step, errReply = r.GetInt(i + 1)
+			if errReply != nil {
+				return errReply
+			}
+			if step <= 0 || step > MaxStep {
+				return ErrInvalidStep
+			}
+			i++
+		case "FORCE":
+			force = true
+		default:
+			return ErrSyntax
+		}
+	}
+	var stepStore StepStore
+	if step != 0 {
+		if stepStore, ok = s.store.(StepStore); !ok || s.isFixedBatch(idGenKey) {
+			return ErrFixedStep
+		}
+	}
 	s.Lock()
 	idgen, ok = s.keyGeneratorMap[idGenKey]
 	if ok == false {
-		idgen, err = NewMySQLIdGenerator(s.db, idGenKey, BatchCount)
+		idgen, err = s.newIdGenerator(idGenKey)
 		if err != nil {
 			s.Unlock()
 			return &ErrorReply{
@@ -72,14 +131,25 @@ func (s *Server) handleSet(r *Request) Reply {
 	}
 
 	s.Unlock()
-	err = s.SetKey(idGenKey)
-	if err != nil {
-		return &ErrorReply{
-			message: err.Error(),
+	var oldValue *int64
+	if s.audit != nil {
+		oldValue = auditValue(s.store, idGenKey)
+	}
+	err = idgen.ResetContext(r.Context(), idValue, force)
+	s.clearKeyCheck(idGenKey)
+	if err == nil && step != 0 {
+		if err = stepStore.SetStep(idGenKey, step); err == nil {
+			idgen.SetBatch(step)
 		}
 	}
-
-	err = idgen.Reset(idValue, false)
+	if s.audit != nil {
+		var newValue *int64
+		if err == nil {
+			v, _ := idgen.Current()
+			newValue = &v
+		}
+		s.recordAudit(r, oldValue, newValue, err)
+	}
 	if err != nil {
 		return &ErrorReply{
 			message: err.Error(),
@@ -92,7 +162,6 @@ func (s *Server) handleSet(r *Request) Reply {
 }
 
 func (s *Server) handleExists(r *Request) Reply {
-	var ok bool
 	var id int64
 
 	if r.HasArgument(0) == false {
@@ -103,9 +172,21 @@ func (s *Server) handleExists(r *Request) Reply {
 	if len(idGenKey) == 0 {
 		return ErrNoKey
 	}
+	if !IsValidKey(idGenKey) {
+		return ErrInvalidKey
+	}
+	idGenKey = namespaceKey(r.Namespace(), idGenKey)
 	s.Lock()
-	_, ok = s.keyGeneratorMap[idGenKey]
+	idgen, ok := s.keyGeneratorMap[idGenKey]
 	s.Unlock()
+	// the storage knows the keys created and deleted by other instances,
+	// the keys in memory are used if it is unavailable
+	if exist, err := s.isKeyExist(idGenKey); err == nil {
+		if ok && !exist {
+			s.forgetKey(idGenKey, idgen)
+		}
+		ok = exist
+	}
 	if ok {
 		id = 1
 	}
@@ -116,8 +197,6 @@ func (s *Server) handleExists(r *Request) Reply {
 }
 
 func (s *Server) handleDel(r *Request) Reply {
-	var idgen *MySQLIdGenerator
-	var ok bool
 	var id int64 = 0
 
 	if r.HasArgument(0) == false {
@@ -128,25 +207,40 @@ func (s *Server) handleDel(r *Request) Reply {
 	if len(idGenKey) == 0 {
 		return ErrNoKey
 	}
+	if !IsValidKey(idGenKey) {
+		return ErrInvalidKey
+	}
+	idGenKey = namespaceKey(r.Namespace(), idGenKey)
+	idgen, err := s.lookupKey(idGenKey)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
 	s.Lock()
-	idgen, ok = s.keyGeneratorMap[idGenKey]
-	if ok {
+	if idgen != nil {
 		delete(s.keyGeneratorMap, idGenKey)
 	}
 	s.Unlock()
-	if ok {
-		err := idgen.DelKeyTable(idGenKey)
-		if err != nil {
-			return &ErrorReply{
-				message: err.Error(),
-			}
+	if idgen != nil {
+		var oldValue *int64
+		if s.audit != nil {
+			oldValue = auditValue(s.store, idGenKey)
+		}
+		err := idgen.Del()
+		s.clearKeyCheck(idGenKey)
+		if st, ok := s.store.(StepStore); ok && err == nil {
+			err = st.SetStep(idGenKey, 0)
+		}
+		if s.audit != nil {
+			s.recordAudit(r, oldValue, nil, err)
 		}
-		err = s.DelKey(idGenKey)
 		if err != nil {
 			return &ErrorReply{
 				message: err.Error(),
 			}
 		}
+		deleteKeyMetrics(idGenKey)
 		id = 1
 	}
 
@@ -164,8 +258,420 @@ func (s *Server) handleSelect(r *Request) Reply {
 	if len(num) == 0 {
 		return ErrNotEnoughArgs
 	}
+	ns, err := strconv.Atoi(num)
+	if err != nil {
+		return ErrExpectInteger
+	}
+	if ns < 0 || ns >= s.namespaces() {
+		return ErrNamespaceOutOfRange
+	}
+	if s.currentACL() != nil && r.Client != nil && r.Client.User != nil && !r.Client.User.CanUseNamespace(ns) {
+		return namespaceDenied(r.Client.User, ns)
+	}
+	if r.Client != nil {
+		r.Client.Namespace = ns
+	}
+
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// redis command(auth password) or (auth username password)
+func (s *Server) handleAuth(r *Request) Reply {
+	var name, password string
+
+	switch len(r.Arguments) {
+	case 0:
+		return ErrNotEnoughArgs
+	case 1:
+		name = DefaultUserName
+		password = string(r.Arguments[0])
+	case 2:
+		name = string(r.Arguments[0])
+		password = string(r.Arguments[1])
+	default:
+		return ErrTooMuchArgs
+	}
+	acl := s.currentACL()
+	if acl == nil {
+		return ErrAuthNotEnabled
+	}
+
+	user, ok := acl.Authenticate(name, password)
+	if ok == false {
+		r.logger().Warn("auth failed",
+			"user", name,
+		)
+		return ErrWrongPass
+	}
+	if r.Client != nil {
+		r.Client.User = user
+	}
+
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// redis command(acl whoami) or (acl list)
+func (s *Server) handleACL(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+
+	switch strings.ToUpper(string(r.Arguments[0])) {
+	case "WHOAMI":
+		name := DefaultUserName
+		if r.Client != nil && r.Client.User != nil {
+			name = r.Client.User.Name
+		}
+		return &BulkReply{
+			value: []byte(name),
+		}
+	case "LIST":
+		acl := s.currentACL()
+		if acl == nil {
+			return &MultiBulkReply{
+				values: [][]byte{[]byte("user default on nopass +@read +@allocate +@admin ~*")},
+			}
+		}
+		if r.Client == nil || r.Client.User == nil || !r.Client.User.CanAccess(CommandClassAdmin, "") {
+			return ErrNoPermission
+		}
+		users := acl.Users()
+		values := make([][]byte, 0, len(users))
+		for _, u := range users {
+			values = append(values, []byte(u.String()))
+		}
+		return &MultiBulkReply{
+			values: values,
+		}
+	default:
+		return ErrMethodNotSupported
+	}
+}
+
+// recordAudit records the SET or DEL of the key in the first argument
+func (s *Server) recordAudit(r *Request, oldValue *int64, newValue *int64, err error) {
+	e := &AuditEntry{
+		Time:      time.Now(),
+		Client:    r.RemoteAddress,
+		Command:   r.Command,
+		Namespace: r.Namespace(),
+		Key:       string(r.Arguments[0]),
+		OldValue:  oldValue,
+		NewValue:  newValue,
+	}
+	if r.Client != nil {
+		e.User = r.Client.UserName()
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	s.audit.Record(e)
+}
+
+// redis command(audit get [count [key]]), every entry is an array of
+// id, unix time, user, client, command, namespace, key, old value,
+// new value and error.
+func (s *Server) handleAudit(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+	if strings.ToUpper(string(r.Arguments[0])) != "GET" {
+		return ErrMethodNotSupported
+	}
+	if len(r.Arguments) > 3 {
+		return ErrTooMuchArgs
+	}
+	if s.audit == nil {
+		return ErrAuditNotEnabled
+	}
+
+	count := int64(DefaultAuditGetCount)
+	if r.HasArgument(1) {
+		var errReply *ErrorReply
+		count, errReply = r.GetInt(1)
+		if errReply != nil {
+			return errReply
+		}
+		if count <= 0 || count > MaxAuditGetCount {
+			return ErrInvalidCount
+		}
+	}
+	key := ""
+	if r.HasArgument(2) {
+		key = string(r.Arguments[2])
+		if !IsValidKey(key) {
+			return ErrInvalidKey
+		}
+	}
+
+	entries, err := s.audit.Entries(r.Namespace(), key, int(count))
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	values := make([]Reply, 0, len(entries))
+	for _, e := range entries {
+		values = append(values, &ArrayReply{
+			values: []Reply{
+				&IntReply{number: e.ID},
+				&IntReply{number: e.Time.Unix()},
+				&BulkReply{value: []byte(e.User)},
+				&BulkReply{value: []byte(e.Client)},
+				&BulkReply{value: []byte(e.Command)},
+				&IntReply{number: int64(e.Namespace)},
+				&BulkReply{value: []byte(e.Key)},
+				auditValueReply(e.OldValue),
+				auditValueReply(e.NewValue),
+				&BulkReply{value: []byte(e.Err)},
+			},
+		})
+	}
+	return &ArrayReply{
+		values: values,
+	}
+}
+
+func auditValueReply(v *int64) Reply {
+	if v == nil {
+		return &BulkReply{}
+	}
+	return &BulkReply{
+		value: []byte(strconv.FormatInt(*v, 10)),
+	}
+}
+
+// redis command(slowlog get [count]), (slowlog len) or (slowlog reset),
+// every entry is an array of id, unix time, duration, arguments, client,
+// user, lock wait and storage time, the times are in microseconds.
+func (s *Server) handleSlowLog(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+
+	switch strings.ToUpper(string(r.Arguments[0])) {
+	case "GET":
+		if len(r.Arguments) > 2 {
+			return ErrTooMuchArgs
+		}
+		count := int64(DefaultSlowLogGetCount)
+		if r.HasArgument(1) {
+			var errReply *ErrorReply
+			count, errReply = r.GetInt(1)
+			if errReply != nil {
+				return errReply
+			}
+			if count < -1 {
+				return ErrInvalidCount
+			}
+		}
+		entries := s.slowlog.Get(int(count))
+		values := make([]Reply, 0, len(entries))
+		for _, e := range entries {
+			values = append(values, &ArrayReply{
+				values: []Reply{
+					&IntReply{number: e.ID},
+					&IntReply{number: e.Time.Unix()},
+					&IntReply{number: e.Duration.Microseconds()},
+					&MultiBulkReply{values: e.Args},
+					&BulkReply{value: []byte(e.Client)},
+					&BulkReply{value: []byte(e.User)},
+					&IntReply{number: e.LockWait.Microseconds()},
+					&IntReply{number: e.Storage.Microseconds()},
+				},
+			})
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "LEN":
+		return &IntReply{
+			number: int64(s.slowlog.Len()),
+		}
+	case "RESET":
+		s.slowlog.Reset()
+		return &StatusReply{
+			code: "OK",
+		}
+	default:
+		return ErrMethodNotSupported
+	}
+}
+
+// redis command(monitor), the connection receives every request served
+// after the reply.
+func (s *Server) handleMonitor(r *Request) Reply {
+	if len(r.Arguments) != 0 {
+		return ErrTooMuchArgs
+	}
+	if r.Client == nil {
+		return ErrMethodNotSupported
+	}
+	r.Client.Monitoring = true
 
 	return &StatusReply{
 		code: "OK",
 	}
 }
+
+// redis command(info [section]), the sections are server, clients, stats,
+// limits and keyspace.
+func (s *Server) handleInfo(r *Request) Reply {
+	section := "all"
+	if r.HasArgument(0) {
+		section = strings.ToLower(string(r.Arguments[0]))
+	}
+	if len(r.Arguments) > 1 {
+		return ErrTooMuchArgs
+	}
+
+	var b strings.Builder
+	writeSection := func(name string, lines ...string) {
+		if section != "all" && section != strings.ToLower(name) {
+			return
+		}
+		if b.Len() != 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + name + "\r\n")
+		for _, line := range lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+
+	writeSection("Server",
+		"storage:"+s.storageName(),
+		"uptime_in_seconds:"+strconv.FormatInt(int64(time.Since(s.startTime).Seconds()), 10),
+	)
+	writeSection("Clients",
+		"connected_clients:"+strconv.FormatInt(s.clients.Load(), 10),
+		"monitors:"+strconv.FormatInt(int64(s.monitors.count.Load()), 10),
+	)
+	writeSection("Stats",
+		"total_commands_processed:"+strconv.FormatInt(s.commands.Load(), 10),
+	)
+	var limits []string
+	if limiter := s.currentLimiter(); limiter != nil {
+		limits = limiter.Info()
+	}
+	writeSection("Limits", limits...)
+
+	keys := make(map[int]int)
+	s.Lock()
+	for key := range s.keyGeneratorMap {
+		if ns, _, ok := splitNamespace(key); ok {
+			keys[ns]++
+		}
+	}
+	s.Unlock()
+	keyspace := make([]string, 0, len(keys))
+	for ns := 0; ns < s.namespaces(); ns++ {
+		if keys[ns] != 0 {
+			keyspace = append(keyspace, "db"+strconv.Itoa(ns)+":keys="+strconv.Itoa(keys[ns]))
+		}
+	}
+	writeSection("Keyspace", keyspace...)
+	writeSection("Reserve", s.reserveInfo()...)
+
+	return &BulkReply{
+		value: []byte(b.String()),
+	}
+}
+
+// redis command(keys pattern), the keys of the namespace matching the glob
+// pattern which the user can read.
+func (s *Server) handleKeys(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+	if len(r.Arguments) > 1 {
+		return ErrTooMuchArgs
+	}
+	pattern := string(r.Arguments[0])
+	if _, err := path.Match(pattern, ""); err != nil {
+		return ErrSyntax
+	}
+
+	// the registry of the storage has the keys created by other instances
+	storeKeys, err := s.store.Keys()
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	keys := make([]string, 0)
+	for _, idGenKey := range storeKeys {
+		ns, key, ok := splitNamespace(idGenKey)
+		if !ok || ns != r.Namespace() {
+			continue
+		}
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	acl := s.currentACL()
+	values := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if acl != nil && (r.Client == nil || r.Client.User == nil || !r.Client.User.CanAccess(CommandClassRead, key)) {
+			continue
+		}
+		values = append(values, []byte(key))
+	}
+	return &MultiBulkReply{
+		values: values,
+	}
+}
+
+// redis command(describe key), the reply is the pairs of the fields
+// current(the last id issued by this idgo), segment_max(the max id of the
+// cached segment), high_water(the high-water mark in the storage) and step.
+func (s *Server) handleDescribe(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+	if len(r.Arguments) > 1 {
+		return ErrTooMuchArgs
+	}
+
+	idGenKey := string(r.Arguments[0])
+	if len(idGenKey) == 0 {
+		return ErrNoKey
+	}
+	if !IsValidKey(idGenKey) {
+		return ErrInvalidKey
+	}
+	idGenKey = namespaceKey(r.Namespace(), idGenKey)
+	idgen, err := s.lookupKey(idGenKey)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	if idgen == nil {
+		return &MultiBulkReply{
+			values: [][]byte{},
+		}
+	}
+
+	cur, segmentMax, step := idgen.Segment()
+	highWater, err := s.store.Current(idGenKey)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	return &MultiBulkReply{
+		values: [][]byte{
+			[]byte("current"), []byte(strconv.FormatInt(cur, 10)),
+			[]byte("segment_max"), []byte(strconv.FormatInt(segmentMax, 10)),
+			[]byte("high_water"), []byte(strconv.FormatInt(highWater, 10)),
+			[]byte("step"), []byte(strconv.FormatInt(step, 10)),
+		},
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var hostileKeys = []string{
+	"x; DROP TABLE users",
+	"x'; DROP TABLE __idgo__; --",
+	"a'b",
+	`a"b`,
+	"a`b",
+	"a b",
+	"a\x00b",
+	"a\r\nb",
+	"a/b",
+	"a\\b",
+	"a%b",
+	"-abc",
+	".abc",
+	"__idgo__",
+	"中文",
+	strings.Repeat("a", MaxKeyLength+1),
+}
+
+func newTestServer(t *testing.T) *Server {
+	s := new(Server)
+	s.store = openTestSQLiteStore(t)
+	s.keyGeneratorMap = make(map[string]*IdGenerator)
+	s.slowlog = NewSlowLog(nil)
+	return s
+}
+
+func newTestRequest(command string, args ...string) *Request {
+	arguments := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		arguments = append(arguments, []byte(arg))
+	}
+	return &Request{
+		Command:   command,
+		Arguments: arguments,
+	}
+}
+
+func replyString(t *testing.T, reply Reply) string {
+	var buf bytes.Buffer
+	if _, err := reply.WriteTo(&buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.String()
+}
+
+func TestHostileKeys(t *testing.T) {
+	s := newTestServer(t)
+	for _, key := range hostileKeys {
+		for _, r := range []*Request{
+			newTestRequest("GET", key),
+			newTestRequest("SET", key, "1"),
+			newTestRequest("EXISTS", key),
+			newTestRequest("DEL", key),
+		} {
+			got := replyString(t, s.ServeRequest(r))
+			if got != "-ERR invalid key\r\n" {
+				t.Fatalf("%s %q: unexpected reply %q", r.Command, key, got)
+			}
+		}
+	}
+
+	keys, err := s.store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 0 || len(s.keyGeneratorMap) != 0 {
+		t.Fatalf("hostile keys are stored: %v", keys)
+	}
+}
+
+func TestValidKeys(t *testing.T) {
+	s := newTestServer(t)
+	for _, key := range []string{"abc", "order_id", "app:user.id", "a-b", "_x", "9", strings.Repeat("a", MaxKeyLength)} {
+		if got := replyString(t, s.ServeRequest(newTestRequest("SET", key, "100"))); got != "+OK\r\n" {
+			t.Fatalf("SET %q: unexpected reply %q", key, got)
+		}
+		if got := replyString(t, s.ServeRequest(newTestRequest("GET", key))); got != "$3\r\n101\r\n" {
+			t.Fatalf("GET %q: unexpected reply %q", key, got)
+		}
+		if got := replyString(t, s.ServeRequest(newTestRequest("EXISTS", key))); got != ":1\r\n" {
+			t.Fatalf("EXISTS %q: unexpected reply %q", key, got)
+		}
+		if got := replyString(t, s.ServeRequest(newTestRequest("DEL", key))); got != ":1\r\n" {
+			t.Fatalf("DEL %q: unexpected reply %q", key, got)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	if got := quoteIdentifier("a`; DROP TABLE b; `"); got != "`a``; DROP TABLE b; ```" {
+		t.Fatalf("unexpected quoted identifier %s", got)
+	}
+}
+
+func TestSelectNamespace(t *testing.T) {
+	s := newTestServer(t)
+	c0, c1 := &Client{}, &Client{}
+	do := func(c *Client, command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		return replyString(t, s.ServeRequest(r))
+	}
+
+	if got := do(c1, "SELECT", "1"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	for _, n := range []string{"16", "-1", "a"} {
+		if got := do(c1, "SELECT", n); got[0] != '-' {
+			t.Fatalf("SELECT %s: unexpected reply %q", n, got)
+		}
+	}
+	if c1.Namespace != 1 {
+		t.Fatalf("expect namespace 1, got %d", c1.Namespace)
+	}
+
+	do(c0, "SET", "abc", "100")
+	do(c1, "SET", "abc", "500")
+	if got := do(c0, "GET", "abc"); got != "$3\r\n101\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "GET", "abc"); got != "$3\r\n501\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "DEL", "abc"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "EXISTS", "abc"); got != ":0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c0, "EXISTS", "abc"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the length of a key does not depend on the namespace
+	long := strings.Repeat("a", MaxKeyLength)
+	if got := do(c1, "SET", long, "1"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "GET", long); got != "$1\r\n2\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "SET", long+"a", "1"); got != "-ERR invalid key\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if _, err := new(MySQLStore).Reset(namespaceKey(1, long), 1, false); err == nil {
+		t.Fatal("expect error of a key longer than a mysql table name")
+	}
+
+	// the keys of namespaces are loaded by Init
+	do(c1, "SET", "abc", "900")
+	s2 := &Server{store: s.store, keyGeneratorMap: make(map[string]*IdGenerator)}
+	if err := s2.Init(); err != nil {
+		t.Fatal(err.Error())
+	}
+	r := newTestRequest("GET", "abc")
+	r.Client = &Client{Namespace: 1}
+	if got := replyString(t, s2.ServeRequest(r)); got != "$3\r\n901\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestSetStepAndForce(t *testing.T) {
+	s := newTestServer(t)
+	do := func(command string, args ...string) string {
+		return replyString(t, s.ServeRequest(newTestRequest(command, args...)))
+	}
+
+	for _, args := range [][]string{
+		{"abc", "1", "STEP"},
+		{"abc", "1", "STEP", "0"},
+		{"abc", "1", "STEP", "a"},
+		{"abc", "1", "STEP", "1000000000"},
+		{"abc", "1", "NX"},
+	} {
+		if got := do("SET", args...); got[0] != '-' {
+			t.Fatalf("SET %v: unexpected reply %q", args, got)
+		}
+	}
+	if got := do("SET", "abc", "100", "step", "10"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	do("GET", "abc")
+	want := "*8\r\n$7\r\ncurrent\r\n$3\r\n101\r\n$11\r\nsegment_max\r\n$3\r\n110\r\n" +
+		"$10\r\nhigh_water\r\n$3\r\n110\r\n$4\r\nstep\r\n$2\r\n10\r\n"
+	if got := do("DESCRIBE", "abc"); got != want {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// SET does not lower the value of an existing key without FORCE
+	do("SET", "abc", "5")
+	if got := do("GET", "abc"); got != "$3\r\n111\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	do("SET", "abc", "5", "FORCE")
+	if got := do("GET", "abc"); got != "$1\r\n6\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the step is loaded with the key and removed with it
+	s2 := &Server{store: s.store, keyGeneratorMap: make(map[string]*IdGenerator)}
+	if err := s2.Init(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, step := s2.keyGeneratorMap["abc"].Segment(); step != 10 {
+		t.Fatalf("expect step 10, got %d", step)
+	}
+	do("DEL", "abc")
+	if step, err := s.store.(StepStore).Step("abc"); err != nil || step != 0 {
+		t.Fatalf("expect no step, got %d %v", step, err)
+	}
+	if got := do("DESCRIBE", "abc"); got != "*0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	s := newTestServer(t)
+	c0, c1 := &Client{}, &Client{Namespace: 1}
+	do := func(c *Client, command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		return replyString(t, s.ServeRequest(r))
+	}
+
+	for _, key := range []string{"order_b", "order_a", "user"} {
+		do(c0, "SET", key, "1")
+	}
+	do(c1, "SET", "order_c", "1")
+	if got := do(c0, "KEYS", "order_*"); got != "*2\r\n$7\r\norder_a\r\n$7\r\norder_b\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c1, "KEYS", "*"); got != "*1\r\n$7\r\norder_c\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(c0, "KEYS", "["); got[0] != '-' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultMaxClients    = 10000
+	DefaultTCPKeepAlive  = 300 // second
+	DefaultMaxArgs       = 1024
+	DefaultMaxBulkLength = 1024 * 1024
+
+	// the time to write the error reply to a rejected connection
+	rejectWriteTimeout = time.Second
+)
+
+// connConfig is the settings of the client connections
+type connConfig struct {
+	maxClients   int64
+	idleTimeout  time.Duration // 0 is no timeout
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	keepAlive    time.Duration // negative disables keepalive
+	limits       RequestLimits
+}
+
+func newConnConfig(c *config.Config) connConfig {
+	cc := connConfig{
+		maxClients: DefaultMaxClients,
+		keepAlive:  DefaultTCPKeepAlive * time.Second,
+		limits:     DefaultRequestLimits,
+	}
+	if c == nil {
+		return cc
+	}
+	if c.MaxClients > 0 {
+		cc.maxClients = int64(c.MaxClients)
+	}
+	cc.idleTimeout = seconds(c.IdleTimeout)
+	cc.readTimeout = seconds(c.ReadTimeout)
+	cc.writeTimeout = seconds(c.WriteTimeout)
+	if c.TCPKeepAlive > 0 {
+		cc.keepAlive = seconds(c.TCPKeepAlive)
+	} else if c.TCPKeepAlive < 0 {
+		cc.keepAlive = -1
+	}
+	if c.MaxArgs > 0 {
+		cc.limits.MaxArgs = c.MaxArgs
+	}
+	if c.MaxBulkLength > 0 {
+		cc.limits.MaxBulkLength = c.MaxBulkLength
+	}
+	return cc
+}
+
+func seconds(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// deadline returns the deadline of timeout from now, the zero time if
+// there is no timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// listen listens on addr with the TCP keepalive period of the connections
+func listen(addr string, keepAlive time.Duration) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// acquireClient counts a new connection, it returns false if the
+// connections reach maxclients.
+func (s *Server) acquireClient(max int64) bool {
+	if s.clients.Add(1) > max {
+		s.clients.Add(-1)
+		return false
+	}
+	return true
+}
+
+// rejectClient replies the error to a connection over maxclients and closes it
+func rejectClient(conn net.Conn) {
+	rejectedConnections.Inc()
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	ErrMaxClients.WriteTo(conn)
+	conn.Close()
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestReadRequest(t *testing.T) {
+	limits := RequestLimits{MaxArgs: 3, MaxBulkLength: 8}
+	read := func(data string) (*Request, error) {
+		return ReadRequest(bufio.NewReaderSize(strings.NewReader(data), 16), limits)
+	}
+
+	r, err := read("*3\r\n$3\r\nset\r\n$3\r\nabc\r\n$8\r\n12345678\r\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Command != "SET" || len(r.Arguments) != 2 || string(r.Arguments[1]) != "12345678" {
+		t.Fatalf("unexpected request %+v", r)
+	}
+
+	for data, want := range map[string]error{
+		"*0\r\n":                            ErrInvalidMultibulkLength,
+		"*-1\r\n":                           ErrInvalidMultibulkLength,
+		"*4\r\n":                            ErrInvalidMultibulkLength,
+		"*1000000000\r\n":                   ErrInvalidMultibulkLength,
+		"*1\r\n$9\r\n":                      ErrInvalidBulkLength,
+		"*1\r\n$-1\r\n":                     ErrInvalidBulkLength,
+		"*1\r\n$999999999999\r\n":           ErrInvalidBulkLength,
+		"*1\r\n$" + strings.Repeat("1", 20): ErrLineTooLong,
+	} {
+		if _, err := read(data); err != want {
+			t.Fatalf("%q: expect %v, got %v", data, want, err)
+		}
+	}
+	for _, data := range []string{
+		"*x\r\n",
+		"*1\n",
+		"*1\r\n$3\r\nabcd\r\n",
+		"*1\r\n$3\r\nab",
+	} {
+		if _, err := read(data); err == nil {
+			t.Fatalf("%q: expect error", data)
+		}
+	}
+
+	// the errors of the reader in an argument are not taken as malformed
+	for _, data := range []string{"*2\r\n$3\r\nGET\r\n", "*2\r\n$3\r\nGET\r\n$5\r\nab"} {
+		if _, err := read(data); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%q: expect %v, got %v", data, io.ErrUnexpectedEOF, err)
+		}
+	}
+
+	// the pipelined requests are read from the same reader
+	reader := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"))
+	for _, key := range []string{"a", "b"} {
+		r, err := ReadRequest(reader, limits)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(r.Arguments[0]) != key {
+			t.Fatalf("expect key %s, got %s", key, r.Arguments[0])
+		}
+	}
+}
+
+func startTestServer(t *testing.T, c *config.Config) *Server {
+	s := newTestServer(t)
+	s.cfg = c
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.listener = ln
+	go s.Serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func TestMaxClients(t *testing.T) {
+	s := startTestServer(t, &config.Config{MaxClients: 1})
+
+	first, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer first.Close()
+	// the first connection is served
+	first.Write([]byte("*2\r\n$6\r\nEXISTS\r\n$1\r\na\r\n"))
+	line, err := bufio.NewReader(first).ReadString('\n')
+	if err != nil || line != ":0\r\n" {
+		t.Fatalf("unexpected reply %q %v", line, err)
+	}
+
+	second, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Close()
+	data, _ := io.ReadAll(second)
+	if string(data) != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startTestServer(t, &config.Config{IdleTimeout: 1})
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("closed before idle timeout: %v", d)
+	}
+}
+
+func TestReadTimeoutInArgument(t *testing.T) {
+	s := startTestServer(t, &config.Config{ReadTimeout: 1})
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	timeouts := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read"))
+	// the client stalls in the middle of the key
+	conn.Write([]byte("*2\r\n$3\r\nGET\r\n$5\r\nab"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, _ := io.ReadAll(conn); len(data) != 0 {
+		t.Fatalf("unexpected reply %q", data)
+	}
+	if got := testutil.ToFloat64(connectionTimeouts.WithLabelValues("read")); got != timeouts+1 {
+		t.Fatalf("expect %v read timeouts, got %v", timeouts+1, got)
+	}
+}
+
+func TestRequestLimitReply(t *testing.T) {
+	s := startTestServer(t, &config.Config{MaxArgs: 2})
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("*1000000000\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := io.ReadAll(conn)
+	if string(data) != "-ERR Protocol error: invalid multibulk length\r\n" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+}
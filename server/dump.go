@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	DumpVersion = 1
+
+	DumpFormatJSON   = "json"
+	DumpFormatNDJSON = "ndjson"
+
+	// the ids skipped over the dumped high-water mark by a restore, they
+	// cover the segments fetched after the dump
+	DefaultRestoreMargin = 100000
+)
+
+// DumpHeader is the first line of a NDJSON dump, and the envelope of the
+// keys of a JSON dump.
+type DumpHeader struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"created_at"`
+	Storage   string       `json:"storage"`
+	Keys      []*DumpedKey `json:"keys,omitempty"`
+}
+
+// DumpedKey is the state of a key in a dump
+type DumpedKey struct {
+	Namespace int    `json:"namespace"`
+	Key       string `json:"key"`
+	HighWater int64  `json:"high_water"`
+	Step      int64  `json:"step"` // 0 if the key has no step
+}
+
+// Dump writes all the keys of store to w in format, it returns the count of
+// keys written.
+func Dump(store SegmentStore, storage string, w io.Writer, format string) (int, error) {
+	if format != DumpFormatJSON && format != DumpFormatNDJSON {
+		return 0, fmt.Errorf("%s:invalid dump format", format)
+	}
+	storeKeys, err := store.Keys()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(storeKeys)
+
+	keys := make([]*DumpedKey, 0, len(storeKeys))
+	for _, storeKey := range storeKeys {
+		ns, key, ok := splitNamespace(storeKey)
+		if !ok {
+			continue
+		}
+		k := &DumpedKey{Namespace: ns, Key: key}
+		if k.HighWater, err = store.Current(storeKey); err != nil {
+			return 0, err
+		}
+		if k.Step, err = explicitStep(store, storeKey); err != nil {
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+
+	header := &DumpHeader{
+		Version:   DumpVersion,
+		CreatedAt: time.Now(),
+		Storage:   storage,
+	}
+	enc := json.NewEncoder(w)
+	if format == DumpFormatJSON {
+		header.Keys = keys
+		enc.SetIndent("", "  ")
+		return len(keys), enc.Encode(header)
+	}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := enc.Encode(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Restore creates the keys of the dump read from r in store, the format
+// is detected. Every key is restored to its dumped high-water mark plus
+// margin, the key which is already higher keeps its value, so the restored
+// keys never issue the ids issued before. namespaces is the count of
+// namespaces configured, 0 is the default. It returns the count of keys restored.
+func Restore(store SegmentStore, r io.Reader, margin int64, namespaces int) (int, error) {
+	if margin < 0 {
+		return 0, fmt.Errorf("%d:margin is negative", margin)
+	}
+	dec := json.NewDecoder(r)
+	var header DumpHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("read dump header error:%v", err)
+	}
+	if header.Version != DumpVersion {
+		return 0, fmt.Errorf("%d:unsupported dump version", header.Version)
+	}
+
+	keys := header.Keys
+	for dec.More() {
+		k := new(DumpedKey)
+		if err := dec.Decode(k); err != nil {
+			return 0, fmt.Errorf("read dump key error:%v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	// validate all the keys before restoring any
+	for _, k := range keys {
+		if !IsValidKey(k.Key) {
+			return 0, fmt.Errorf("%d:%s:invalid key", k.Namespace, k.Key)
+		}
+		if k.Namespace < 0 || k.Namespace >= namespaceCount(namespaces) {
+			return 0, fmt.Errorf("%d:%s:namespace is out of range", k.Namespace, k.Key)
+		}
+		if k.HighWater > math.MaxInt64-margin {
+			return 0, fmt.Errorf("%s:high-water mark is out of range", k.Key)
+		}
+		if k.Step < 0 || k.Step > MaxStep {
+			return 0, fmt.Errorf("%s:step is out of range", k.Key)
+		}
+	}
+
+	for i, k := range keys {
+		if err := restoreKey(store, k, margin); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+func restoreKey(store SegmentStore, k *DumpedKey, margin int64) error {
+	key := namespaceKey(k.Namespace, k.Key)
+	value := k.HighWater + margin
+	exist, err := store.IsKeyExist(key)
+	if err != nil {
+		return err
+	}
+	cur := int64(0)
+	if exist {
+		if cur, err = store.Current(key); err != nil {
+			return err
+		}
+	}
+	if !exist || cur < value {
+		if _, err := store.Reset(key, value, true); err != nil {
+			return err
+		}
+		if err := bumpGeneration(store, key); err != nil {
+			return err
+		}
+	}
+
+	if k.Step == 0 {
+		return nil
+	}
+	if b, ok := store.(BatchSizer); ok && b.BatchSize(key) != 0 {
+		return nil
+	}
+	if st, ok := store.(StepStore); ok {
+		return st.SetStep(key, k.Step)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	src := openTestSQLiteStore(t)
+	src.Reset("order", 100, false)
+	src.Reset("__1__order", 7, false)
+	src.(StepStore).SetStep("order", 50)
+	// an explicit step equal to the default batch is kept
+	src.Reset("user", 1, false)
+	src.(StepStore).SetStep("user", BatchCount)
+
+	for _, format := range []string{DumpFormatJSON, DumpFormatNDJSON} {
+		var buf bytes.Buffer
+		n, err := Dump(src, StorageSQLite, &buf, format)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if n != 3 {
+			t.Fatalf("expect 3 keys, got %d", n)
+		}
+		if format == DumpFormatNDJSON && strings.Count(buf.String(), "\n") != 4 {
+			t.Fatalf("unexpected dump %s", buf.String())
+		}
+
+		dst := openTestSQLiteStore(t)
+		// a key already over the dump keeps its value
+		dst.Reset("__1__order", 500000, false)
+		if n, err := Restore(dst, &buf, 1000, 0); err != nil || n != 3 {
+			t.Fatalf("restore %d keys error %v", n, err)
+		}
+		for key, want := range map[string]int64{"order": 1100, "__1__order": 500000} {
+			if id, _ := dst.Current(key); id != want {
+				t.Fatalf("%s: expect %d, got %d", key, want, id)
+			}
+		}
+		for key, want := range map[string]int64{"order": 50, "user": BatchCount, "__1__order": 0} {
+			if step, _ := dst.(StepStore).Step(key); step != want {
+				t.Fatalf("%s: expect step %d, got %d", key, want, step)
+			}
+		}
+	}
+
+	dst := openTestSQLiteStore(t)
+	for _, data := range []string{
+		``,
+		`{"version":2}`,
+		`{"version":1}` + "\n" + `{"namespace":0,"key":"a b","high_water":1}`,
+		`{"version":1}` + "\n" + `{"namespace":0,"key":"a","high_water":9223372036854775807}`,
+		`{"version":1}` + "\n" + `{"namespace":0,"key":"a","high_water":1,"step":-1}`,
+		`{"version":1}` + "\n" + `{"namespace":-1,"key":"a","high_water":1}`,
+		`{"version":1}` + "\n" + `{"namespace":16,"key":"a","high_water":1}`,
+	} {
+		if _, err := Restore(dst, strings.NewReader(data), 1, 0); err == nil {
+			t.Fatalf("%q: expect error", data)
+		}
+	}
+	if keys, _ := dst.Keys(); len(keys) != 0 {
+		t.Fatalf("expect no key restored, got %v", keys)
+	}
+}
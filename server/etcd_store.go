@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultEtcdPrefix         = "/idgo/"
+	DefaultEtcdDialTimeout    = 5000 // millisecond
+	DefaultEtcdRequestTimeout = 3000 // millisecond
+
+	etcdStepSuffix       = "_step/"
+	etcdGenerationSuffix = "_generation/"
+	etcdAuditSuffix      = "_audit/"
+)
+
+// EtcdStore stores the high-water mark of every key in etcd under prefix,
+// the keys under prefix are the key registry. A segment is allocated with
+// a transaction which only succeeds when the key is not modified since read.
+type EtcdStore struct {
+	client  *clientv3.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func NewEtcdStore(c *config.EtcdConfig) (*EtcdStore, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd:have no endpoints")
+	}
+	dialTimeout := c.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultEtcdDialTimeout
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints,
+		Username:    c.User,
+		Password:    c.Password,
+		DialTimeout: time.Duration(dialTimeout) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewEtcdStoreWithClient(client, c.Prefix, c.RequestTimeout), nil
+}
+
+// NewEtcdStoreWithClient creates an EtcdStore on a connected client,
+// requestTimeout is in millisecond.
+func NewEtcdStoreWithClient(client *clientv3.Client, prefix string, requestTimeout int) *EtcdStore {
+	if len(prefix) == 0 {
+		prefix = DefaultEtcdPrefix
+	}
+	// the steps and the generations are siblings of the prefix directory,
+	// a prefix without "/" would cover them
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultEtcdRequestTimeout
+	}
+	return &EtcdStore{
+		client:  client,
+		prefix:  prefix,
+		timeout: time.Duration(requestTimeout) * time.Millisecond,
+	}
+}
+
+func (s *EtcdStore) path(key string) string {
+	return s.prefix + key
+}
+
+// stepPath is out of prefix, so the steps are not listed as keys
+func (s *EtcdStore) stepPath(key string) string {
+	return strings.TrimSuffix(s.prefix, "/") + etcdStepSuffix + key
+}
+
+func (s *EtcdStore) Init() error {
+	return nil
+}
+
+func (s *EtcdStore) Keys() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		idGenKey := strings.TrimPrefix(string(kv.Key), s.prefix)
+		if idGenKey != "" {
+			keys = append(keys, idGenKey)
+		}
+	}
+	return keys, nil
+}
+
+func (s *EtcdStore) IsKeyExist(key string) (bool, error) {
+	if len(key) == 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.path(key), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count != 0, nil
+}
+
+func (s *EtcdStore) Current(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	id, _, err := s.get(ctx, key)
+	return id, err
+}
+
+// get returns the value and the mod revision of key
+func (s *EtcdStore) get(ctx context.Context, key string) (int64, int64, error) {
+	resp, err := s.client.Get(ctx, s.path(key))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, 0, fmt.Errorf("%s:have no id key", key)
+	}
+	id, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s:invalid id value %q", key, resp.Kvs[0].Value)
+	}
+	return id, resp.Kvs[0].ModRevision, nil
+}
+
+func (s *EtcdStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+func (s *EtcdStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	for {
+		id, rev, err := s.get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		k := s.path(key)
+		resp, err := s.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", rev)).
+			Then(clientv3.OpPut(k, strconv.FormatInt(id+step, 10))).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if resp.Succeeded {
+			return id, nil
+		}
+		// the key is modified by other idgo, read it again
+	}
+}
+
+func (s *EtcdStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	k := s.path(key)
+	value := strconv.FormatInt(idOffset, 10)
+	if force {
+		_, err := s.client.Put(ctx, k, value)
+		if err != nil {
+			return 0, err
+		}
+		return idOffset, nil
+	}
+
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(k), "=", 0)).
+		Then(clientv3.OpPut(k, value)).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Succeeded {
+		return idOffset, nil
+	}
+	id, _, err := s.get(ctx, key)
+	return id, err
+}
+
+func (s *EtcdStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.Delete(ctx, s.path(key))
+	return err
+}
+
+func (s *EtcdStore) Step(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.stepPath(key))
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, err
+	}
+	step, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s:invalid step value %q", key, resp.Kvs[0].Value)
+	}
+	return step, nil
+}
+
+func (s *EtcdStore) SetStep(key string, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var err error
+	if step == 0 {
+		_, err = s.client.Delete(ctx, s.stepPath(key))
+	} else {
+		_, err = s.client.Put(ctx, s.stepPath(key), strconv.FormatInt(step, 10))
+	}
+	return err
+}
+
+// generationPath is out of prefix like stepPath
+func (s *EtcdStore) generationPath(key string) string {
+	return strings.TrimSuffix(s.prefix, "/") + etcdGenerationSuffix + key
+}
+
+// Generation is the mod revision of the generation path, every put
+// changes it.
+func (s *EtcdStore) Generation(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.generationPath(key))
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, err
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+func (s *EtcdStore) BumpGeneration(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.Put(ctx, s.generationPath(key), "")
+	return err
+}
+
+// auditPath is out of prefix like stepPath, the entries of a key are
+// under the directory of its namespace, keys have no "/".
+func (s *EtcdStore) auditPath(ns int, key string) string {
+	path := strings.TrimSuffix(s.prefix, "/") + etcdAuditSuffix + strconv.Itoa(ns) + "/"
+	if len(key) != 0 {
+		path += key + "/"
+	}
+	return path
+}
+
+func (s *EtcdStore) InitAudit() error {
+	return nil
+}
+
+// AppendAudit puts e under the directory of its key, the id of the entry
+// is the revision of the put. The namespace keeps the latest
+// MaxStoredAuditEntries entries.
+func (s *EtcdStore) AppendAudit(e *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d%08x", e.Time.UnixNano(), rand.Uint32())
+	resp, err := s.client.Put(ctx, s.auditPath(e.Namespace, e.Key)+name, string(data))
+	if err != nil {
+		return err
+	}
+	e.ID = resp.Header.Revision
+
+	dir := s.auditPath(e.Namespace, "")
+	countResp, err := s.client.Get(ctx, dir, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || countResp.Count <= MaxStoredAuditEntries {
+		return err
+	}
+	oldest, err := s.client.Get(ctx, dir, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend),
+		clientv3.WithLimit(countResp.Count-MaxStoredAuditEntries),
+	)
+	if err != nil {
+		return err
+	}
+	for _, kv := range oldest.Kvs {
+		if _, err := s.client.Delete(ctx, string(kv.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EtcdStore) AuditEntries(ns int, key string, count int) ([]*AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.auditPath(ns, key), clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend),
+		clientv3.WithLimit(int64(count)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*AuditEntry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		e := new(AuditEntry)
+		if err := json.Unmarshal(kv.Value, e); err != nil {
+			return nil, fmt.Errorf("audit:invalid entry %q", kv.Value)
+		}
+		e.ID = kv.ModRevision
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Ping reads the prefix with a linearizable read, which needs the quorum
+// of the cluster.
+func (s *EtcdStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.client.Get(ctx, s.prefix, clientv3.WithCountOnly())
+	return err
+}
+
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
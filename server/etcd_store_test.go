@@ -0,0 +1,178 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func newTestEtcdStore(t *testing.T) *EtcdStore {
+	dir, err := ioutil.TempDir("", "idgo-etcd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() {
+		etcd.Close()
+		os.RemoveAll(dir)
+	})
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd start timeout")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcd.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store := NewEtcdStoreWithClient(client, "/idgo_test/", 0)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestEtcdIdgen(t *testing.T) {
+	store := newTestEtcdStore(t)
+	idGenerator, err := NewIdGenerator(store, "etcd_victory", 100)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = idGenerator.Reset(1, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	ids := make(map[int64]bool)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := idGenerator.Next()
+				if err != nil {
+					t.Error(err.Error())
+					return
+				}
+				lock.Lock()
+				ids[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ids) != 1000 {
+		t.Fatalf("expect 1000 unique ids, got %d", len(ids))
+	}
+	id, err := idGenerator.Next()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != 1002 {
+		t.Fatalf("expect 1002, got %d", id)
+	}
+}
+
+func TestEtcdSegmentsNotOverlap(t *testing.T) {
+	store := newTestEtcdStore(t)
+	// two generators on the same key act as two idgo instances
+	a, _ := NewIdGenerator(store, "shared", 10)
+	b, _ := NewIdGenerator(store, "shared", 10)
+	if err := a.Reset(0, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the existing value is kept when force is false
+	if _, err := a.Next(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Reset(500, false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids := make(map[int64]bool)
+	for i := 0; i < 50; i++ {
+		for _, g := range []*IdGenerator{a, b} {
+			id, err := g.Next()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if ids[id] {
+				t.Fatalf("id %d issued twice", id)
+			}
+			ids[id] = true
+		}
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || keys[0] != "shared" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if err := a.Del(); err != nil {
+		t.Fatal(err.Error())
+	}
+	exist, err := store.IsKeyExist("shared")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exist {
+		t.Fatal("key should be deleted")
+	}
+}
+
+func TestEtcdPrefixWithoutSlash(t *testing.T) {
+	store := NewEtcdStoreWithClient(newTestEtcdStore(t).client, "/idgo_noslash", 0)
+	if _, err := store.Reset("order", 1, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := store.SetStep("order", 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := store.BumpGeneration("order"); err != nil {
+		t.Fatal(err.Error())
+	}
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || keys[0] != "order" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestEtcdAudit(t *testing.T) {
+	store := newTestEtcdStore(t)
+	testAuditStore(t, store)
+
+	// the audit entries are not listed as keys
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"modernc.org/sqlite"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultFetchRetries    = 2
+	DefaultFetchBackoff    = 50   // millisecond
+	DefaultFetchMaxBackoff = 1000 // millisecond
+	DefaultFetchTimeout    = 3000 // millisecond
+	DefaultBreakerFailures = 5
+	DefaultBreakerCooldown = 5000 // millisecond
+
+	// the backend of the stores which are not a Backender
+	DefaultBackend = "default"
+
+	// the states of the circuit breaker
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// ErrStorageUnavailable is returned without trying the storage while the
+// circuit breaker is open.
+var ErrStorageUnavailable = errors.New("storage is unavailable, the circuit breaker is open")
+
+// Fetcher fetches the segments with the retries, the timeout and a
+// circuit breaker of every backend of the storage.
+type Fetcher struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	failures   int // the failures to open a breaker, 0 if the breakers are disabled
+	cooldown   time.Duration
+	now        func() time.Time
+
+	lock     sync.Mutex
+	breakers map[string]*breaker // backend -> breaker
+}
+
+func NewFetcher(c *config.FetchConfig) *Fetcher {
+	if c == nil {
+		c = &config.FetchConfig{}
+	}
+	f := &Fetcher{
+		retries:    c.Retries,
+		backoff:    milliseconds(c.Backoff, DefaultFetchBackoff),
+		maxBackoff: milliseconds(c.MaxBackoff, DefaultFetchMaxBackoff),
+		timeout:    milliseconds(c.Timeout, DefaultFetchTimeout),
+		cooldown:   milliseconds(c.BreakerCooldown, DefaultBreakerCooldown),
+		now:        time.Now,
+		breakers:   make(map[string]*breaker),
+	}
+	if f.retries == 0 {
+		f.retries = DefaultFetchRetries
+	} else if f.retries < 0 {
+		f.retries = 0
+	}
+	if f.maxBackoff < f.backoff {
+		f.maxBackoff = f.backoff
+	}
+	if c.BreakerFailures == 0 {
+		f.failures = DefaultBreakerFailures
+	} else if c.BreakerFailures > 0 {
+		f.failures = c.BreakerFailures
+	}
+	return f
+}
+
+// breakerOf returns the breaker of the backend of key in store, nil if the
+// breakers are disabled.
+func (f *Fetcher) breakerOf(store SegmentStore, key string) *breaker {
+	if f.failures == 0 {
+		return nil
+	}
+	backend := DefaultBackend
+	if b, ok := store.(Backender); ok {
+		backend = b.Backend(key)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	b, ok := f.breakers[backend]
+	if !ok {
+		b = &breaker{
+			backend:  backend,
+			failures: f.failures,
+			cooldown: f.cooldown,
+			now:      f.now,
+		}
+		f.breakers[backend] = b
+		breakerState.WithLabelValues(backend).Set(breakerClosed)
+	}
+	return b
+}
+
+// Fetch fetches a segment of key from store, the retryable errors are
+// retried. A retried fetch may skip the segment committed by the failed
+// one, but it never issues an id twice.
+func (f *Fetcher) Fetch(ctx context.Context, store SegmentStore, key string, step int64) (int64, error) {
+	breaker := f.breakerOf(store, key)
+	for attempt := 0; ; attempt++ {
+		if breaker != nil && !breaker.allow() {
+			breakerRejected.Inc()
+			return 0, ErrStorageUnavailable
+		}
+		id, err := f.fetchOnce(ctx, store, key, step)
+		if err == nil {
+			if breaker != nil {
+				breaker.success()
+			}
+			return id, nil
+		}
+		// the request is canceled or wrong, it tells nothing of the storage
+		if ctx.Err() != nil || !isRetryable(err) {
+			if breaker != nil {
+				breaker.release()
+			}
+			return 0, err
+		}
+		if breaker != nil {
+			breaker.failure(key, err)
+		}
+		if attempt >= f.retries {
+			return 0, err
+		}
+		segmentFetchRetries.Inc()
+		logger.Warn("retry segment fetch",
+			"key", key,
+			"attempt", attempt+1,
+			"err", err,
+		)
+		if err := sleepContext(ctx, f.backoffOf(attempt)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// openBreakers returns the time left before every open breaker lets a
+// fetch try its backend, by the backend.
+func (f *Fetcher) openBreakers() map[string]time.Duration {
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	open := make(map[string]time.Duration)
+	for backend, b := range f.breakers {
+		if wait := b.wait(); wait > 0 {
+			open[backend] = wait
+		}
+	}
+	return open
+}
+
+func (f *Fetcher) fetchOnce(ctx context.Context, store SegmentStore, key string, step int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	id, err := fetchContext(ctx, store, key, step)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		segmentFetchTimeouts.Inc()
+	}
+	return id, err
+}
+
+// backoffOf returns a random backoff up to backoff*2^attempt, capped by maxBackoff
+func (f *Fetcher) backoffOf(attempt int) time.Duration {
+	d := f.maxBackoff
+	if attempt < 16 && f.backoff<<attempt < d {
+		d = f.backoff << attempt
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchContext fetches with ctx if store supports it
+func fetchContext(ctx context.Context, store SegmentStore, key string, step int64) (int64, error) {
+	if f, ok := store.(ContextFetcher); ok {
+		return f.FetchContext(ctx, key, step)
+	}
+	return store.Fetch(key, step)
+}
+
+// isRetryable returns true if err is a transient error of the storage,
+// such as a deadlock, a lost connection or a timeout.
+func isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// deadlock and lock wait timeout
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// SQLITE_BUSY and SQLITE_LOCKED
+		code := sqliteErr.Code() & 0xff
+		return code == 5 || code == 6
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr)
+}
+
+// breaker is the circuit breaker of a backend, it opens after failures
+// failed fetches in a row, and lets one fetch try after cooldown. The
+// breaker closes if the fetch succeeds, or opens again.
+type breaker struct {
+	backend  string
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	lock     sync.Mutex
+	state    int
+	failed   int
+	openedAt time.Time
+}
+
+// wait returns the time left of the cooldown while the breaker is open
+func (b *breaker) wait() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.cooldown-b.now().Sub(b.openedAt), 0)
+}
+
+// allow returns true if a fetch can try the storage
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	default:
+		// the trial fetch is running
+		return false
+	}
+}
+
+func (b *breaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failed = 0
+	if b.state != breakerClosed {
+		logger.Info("storage circuit breaker closed",
+			"backend", b.backend,
+		)
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *breaker) failure(key string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failed++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failed >= b.failures {
+		logger.Error("storage circuit breaker open",
+			"backend", b.backend,
+			"key", key,
+			"failures", b.failed,
+			"cooldown", b.cooldown,
+			"err", err,
+		)
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// release lets another fetch try if the trial fetch is canceled or failed
+// by an error which is not of the storage
+func (b *breaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen)
+	}
+}
+
+// setState must be called with the lock
+func (b *breaker) setState(state int) {
+	b.state = state
+	breakerState.WithLabelValues(b.backend).Set(float64(state))
+}
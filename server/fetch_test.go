@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+// flakyStore fails the first fails fetches with err
+type flakyStore struct {
+	SegmentStore
+	fails   int
+	err     error
+	fetches int
+	block   bool // block until the fetch is canceled
+}
+
+func (s *flakyStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+func (s *flakyStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	s.fetches++
+	if s.block {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	if s.fetches <= s.fails {
+		return 0, s.err
+	}
+	return 100, nil
+}
+
+func TestFetchRetry(t *testing.T) {
+	f := NewFetcher(&config.FetchConfig{Retries: 2, Backoff: 1, MaxBackoff: 2, BreakerFailures: -1})
+
+	store := &flakyStore{fails: 2, err: io.ErrUnexpectedEOF}
+	id, err := f.Fetch(context.Background(), store, "order", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != 100 || store.fetches != 3 {
+		t.Fatalf("unexpected id %d after %d fetches", id, store.fetches)
+	}
+
+	store = &flakyStore{fails: 3, err: io.ErrUnexpectedEOF}
+	if _, err := f.Fetch(context.Background(), store, "order", 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if store.fetches != 3 {
+		t.Fatalf("expect 3 fetches, got %d", store.fetches)
+	}
+
+	// the errors which are not transient are not retried
+	store = &flakyStore{fails: 1, err: errors.New("order:have no id key")}
+	if _, err := f.Fetch(context.Background(), store, "order", 10); err == nil || store.fetches != 1 {
+		t.Fatalf("unexpected error %v after %d fetches", err, store.fetches)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	f := NewFetcher(&config.FetchConfig{Retries: -1, Timeout: 10, BreakerFailures: -1})
+	store := &flakyStore{block: true}
+	start := time.Now()
+	if _, err := f.Fetch(context.Background(), store, "order", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the fetch is not timed out")
+	}
+}
+
+func TestFetchBreaker(t *testing.T) {
+	f := NewFetcher(&config.FetchConfig{Retries: -1, BreakerFailures: 2, BreakerCooldown: 1000})
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	store := &flakyStore{fails: 3, err: io.ErrUnexpectedEOF}
+	for i := 0; i < 2; i++ {
+		if _, err := f.Fetch(context.Background(), store, "order", 10); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	// the breaker is open, the storage is not tried
+	if _, err := f.Fetch(context.Background(), store, "order", 10); err != ErrStorageUnavailable {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if store.fetches != 2 {
+		t.Fatalf("expect 2 fetches, got %d", store.fetches)
+	}
+
+	// the trial fetch after the cooldown fails, the breaker opens again
+	now = now.Add(time.Second)
+	if _, err := f.Fetch(context.Background(), store, "order", 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := f.Fetch(context.Background(), store, "order", 10); err != ErrStorageUnavailable {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// an error which is not of the storage does not close the breaker
+	now = now.Add(time.Second)
+	wrong := &flakyStore{fails: 1, err: errors.New("order:have no id key")}
+	if _, err := f.Fetch(context.Background(), wrong, "order", 10); err != wrong.err {
+		t.Fatalf("unexpected error %v", err)
+	}
+	down := &flakyStore{fails: 10, err: io.ErrUnexpectedEOF}
+	if _, err := f.Fetch(context.Background(), down, "order", 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := f.Fetch(context.Background(), down, "order", 10); err != ErrStorageUnavailable {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the trial fetch succeeds, the breaker closes
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if id, err := f.Fetch(context.Background(), store, "order", 10); err != nil || id != 100 {
+			t.Fatalf("unexpected id %d error %v", id, err)
+		}
+	}
+}
+
+// shardedStore places the keys of every prefix on its own backend
+type shardedStore struct {
+	*flakyStore
+}
+
+func (s *shardedStore) Backend(key string) string {
+	return key[:1]
+}
+
+func TestFetchBreakerPerBackend(t *testing.T) {
+	f := NewFetcher(&config.FetchConfig{Retries: -1, BreakerFailures: 1, BreakerCooldown: 60000})
+	store := &shardedStore{&flakyStore{fails: 1, err: io.ErrUnexpectedEOF}}
+	if _, err := f.Fetch(context.Background(), store, "a_order", 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := f.Fetch(context.Background(), store, "a_user", 10); err != ErrStorageUnavailable {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the keys of the other backends are not failed fast
+	if id, err := f.Fetch(context.Background(), store, "b_order", 10); err != nil || id != 100 {
+		t.Fatalf("unexpected id %d error %v", id, err)
+	}
+	if open := f.openBreakers(); len(open) != 1 || open["a"] == 0 {
+		t.Fatalf("unexpected open breakers %v", open)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// DefaultKeyCheckInterval is the millisecond between the checks of the
+	// generation of a key
+	DefaultKeyCheckInterval = 1000
+	// MaxKeyChecks is the number of the cached results of the key
+	// registry lookups
+	MaxKeyChecks = 10000
+)
+
+// keyCheck is a result of the key registry lookup
+type keyCheck struct {
+	exist bool
+	at    time.Time
+}
+
+// bumpGeneration changes the generation of key if store keeps one
+func bumpGeneration(store SegmentStore, key string) error {
+	if gs, ok := store.(GenerationStore); ok {
+		return gs.BumpGeneration(key)
+	}
+	return nil
+}
+
+// readGeneration returns the generation of the key before a fetch, it must
+// be called with the lock.
+func (m *IdGenerator) readGeneration() (int64, error) {
+	gs, ok := m.store.(GenerationStore)
+	if !ok || m.checkInterval <= 0 {
+		return 0, nil
+	}
+	generation, err := gs.Generation(m.key)
+	if err == nil {
+		m.checkedAt.Store(time.Now().UnixNano())
+	}
+	return generation, err
+}
+
+// pollGeneration reads the generation of the key if it has not been read
+// for checkInterval, it returns false if it is not read. Only one request
+// reads it at a time, and without the lock, so the other requests are not
+// blocked by the storage.
+func (m *IdGenerator) pollGeneration() (int64, bool) {
+	gs, ok := m.store.(GenerationStore)
+	if !ok || m.checkInterval <= 0 {
+		return 0, false
+	}
+	now := time.Now().UnixNano()
+	checkedAt := m.checkedAt.Load()
+	if now-checkedAt < int64(m.checkInterval) || !m.checkedAt.CompareAndSwap(checkedAt, now) {
+		return 0, false
+	}
+	generation, err := gs.Generation(m.key)
+	if err != nil {
+		logger.Warn("check generation of key error",
+			"key", m.key,
+			"err", err,
+		)
+		return 0, false
+	}
+	return generation, true
+}
+
+// checkGeneration drops the cached segment if the key has been reset or
+// deleted by another instance since the segment was fetched. The
+// generations only grow, so a generation read before the fetch of the
+// cached segment is older and ignored. The ids of a stale segment are
+// still issued until the next check, for up to checkInterval and a read
+// of the generation. It must be called with the lock.
+func (m *IdGenerator) checkGeneration(generation int64) {
+	if generation <= m.generation {
+		return
+	}
+	logger.Info("segment of key is stale, the key was reset or deleted",
+		"key", m.key,
+		"generation", m.generation,
+		"new_generation", generation,
+	)
+	staleSegments.WithLabelValues(m.key).Inc()
+	m.batchMax = m.cur
+	m.clearReserve()
+}
+
+// keyCheckInterval returns the interval of the generation checks of the keys
+func (s *Server) keyCheckInterval() time.Duration {
+	if s.cfg == nil || s.cfg.KeyCheckInterval == 0 {
+		return DefaultKeyCheckInterval * time.Millisecond
+	}
+	if s.cfg.KeyCheckInterval < 0 {
+		return 0
+	}
+	return time.Duration(s.cfg.KeyCheckInterval) * time.Millisecond
+}
+
+// lookupKey returns the id generator of key, a key missing in memory is
+// looked up in the registry of the store, so the keys created by another
+// instance are found. It returns nil if the key does not exist.
+func (s *Server) lookupKey(key string) (*IdGenerator, error) {
+	s.Lock()
+	idgen, ok := s.keyGeneratorMap[key]
+	s.Unlock()
+	if ok {
+		return idgen, nil
+	}
+
+	exist, err := s.isKeyExist(key)
+	if err != nil || !exist {
+		return nil, err
+	}
+	idgen, err = s.newIdGenerator(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// the key may be loaded by another request meanwhile
+	if loaded, ok := s.keyGeneratorMap[key]; ok {
+		return loaded, nil
+	}
+	s.keyGeneratorMap[key] = idgen
+	logger.Info("load key from storage",
+		"key", key,
+	)
+	return idgen, nil
+}
+
+// forgetKey removes idgen of the key deleted by another instance
+func (s *Server) forgetKey(key string, idgen *IdGenerator) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.keyChecks, key)
+	if s.keyGeneratorMap[key] == idgen {
+		delete(s.keyGeneratorMap, key)
+		deleteKeyMetrics(key)
+		logger.Info("forget key deleted from storage",
+			"key", key,
+		)
+	}
+}
+
+// isKeyExist looks key up in the registry of the store, the result is
+// kept for keyCheckInterval, so the lookups of a missing key and EXISTS
+// do not read the storage on every request.
+func (s *Server) isKeyExist(key string) (bool, error) {
+	interval := s.keyCheckInterval()
+	s.Lock()
+	c, ok := s.keyChecks[key]
+	s.Unlock()
+	if ok && time.Since(c.at) < interval {
+		return c.exist, nil
+	}
+
+	exist, err := s.store.IsKeyExist(key)
+	if err != nil || interval <= 0 {
+		return exist, err
+	}
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	if len(s.keyChecks) >= MaxKeyChecks {
+		for k, c := range s.keyChecks {
+			if now.Sub(c.at) >= interval {
+				delete(s.keyChecks, k)
+			}
+		}
+	}
+	if s.keyChecks == nil || len(s.keyChecks) >= MaxKeyChecks {
+		s.keyChecks = make(map[string]keyCheck)
+	}
+	s.keyChecks[key] = keyCheck{exist: exist, at: now}
+	return exist, nil
+}
+
+// clearKeyCheck drops the cached lookup of key created or deleted by
+// this instance
+func (s *Server) clearKeyCheck(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.keyChecks, key)
+}
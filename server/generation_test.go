@@ -0,0 +1,184 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestCrossInstanceKeys(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t)
+	s2.store = s1.store
+	for _, s := range []*Server{s1, s2} {
+		s.cfg = &config.Config{KeyCheckInterval: 1}
+	}
+	do := func(s *Server, command string, args ...string) string {
+		return replyString(t, s.ServeRequest(newTestRequest(command, args...)))
+	}
+
+	// the key created on s1 is found by s2
+	if got := do(s1, "SET", "order", "100"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(s2, "EXISTS", "order"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(s2, "KEYS", "*"); got != "*1\r\n$5\r\norder\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(s2, "GET", "order"); got != "$3\r\n101\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// s2 drops its segment after the key is reset by s1
+	if got := do(s1, "SET", "order", "5000", "FORCE"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := do(s2, "GET", "order"); got != "$4\r\n5001\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do(s1, "GET", "order"); got != "$4\r\n7001\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the key deleted by s1 is forgotten by s2
+	if got := do(s1, "DEL", "order"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := do(s2, "GET", "order"); got != "$-1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if _, ok := s2.keyGeneratorMap["order"]; ok {
+		t.Fatal("the deleted key is kept")
+	}
+	if got := do(s2, "EXISTS", "order"); got != ":0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+// slowGenerationStore signals reading and blocks the reads of the
+// generation until release is closed
+type slowGenerationStore struct {
+	SegmentStore
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowGenerationStore) Generation(key string) (int64, error) {
+	select {
+	case s.reading <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.SegmentStore.(GenerationStore).Generation(key)
+}
+
+func (s *slowGenerationStore) BumpGeneration(key string) error {
+	return s.SegmentStore.(GenerationStore).BumpGeneration(key)
+}
+
+func TestGenerationReadWithoutLock(t *testing.T) {
+	store := &slowGenerationStore{
+		SegmentStore: openTestSQLiteStore(t),
+		reading:      make(chan struct{}, 1),
+		release:      make(chan struct{}),
+	}
+	store.Reset("order", 0, false)
+	idgen, err := NewIdGenerator(store, "order", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	idgen.checkInterval = time.Hour
+	// the generation is read before the first fetch
+	close(store.release)
+	if id, err := idgen.Next(); err != nil || id != 1 {
+		t.Fatalf("unexpected id %d %v", id, err)
+	}
+	<-store.reading
+
+	// a slow check does not block the other requests
+	store.release = make(chan struct{})
+	idgen.checkedAt.Store(0)
+	done := make(chan int64)
+	go func() {
+		id, _ := idgen.Next()
+		done <- id
+	}()
+	<-store.reading
+	if id, err := idgen.Next(); err != nil || id != 2 {
+		t.Fatalf("unexpected id %d %v", id, err)
+	}
+
+	// the segment is dropped after the check finds the key was reset
+	if _, err := store.Reset("order", 1000, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	store.BumpGeneration("order")
+	close(store.release)
+	if id := <-done; id != 1001 {
+		t.Fatalf("expect id 1001, got %d", id)
+	}
+	<-store.reading
+}
+
+// lookupCountStore counts the lookups of the key registry
+type lookupCountStore struct {
+	SegmentStore
+	lookups atomic.Int64
+}
+
+func (s *lookupCountStore) IsKeyExist(key string) (bool, error) {
+	s.lookups.Add(1)
+	return s.SegmentStore.IsKeyExist(key)
+}
+
+func TestKeyLookupCache(t *testing.T) {
+	s := newTestServer(t)
+	store := &lookupCountStore{SegmentStore: s.store}
+	s.store = store
+	s.cfg = &config.Config{KeyCheckInterval: 50}
+	do := func(command string, args ...string) string {
+		return replyString(t, s.ServeRequest(newTestRequest(command, args...)))
+	}
+
+	// a missing key is looked up once in the interval
+	for i := 0; i < 3; i++ {
+		if got := do("GET", "order"); got != "$-1\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+		if got := do("EXISTS", "order"); got != ":0\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	if n := store.lookups.Load(); n != 1 {
+		t.Fatalf("expect 1 lookup, got %d", n)
+	}
+
+	// the key created by this instance is not hidden by the cache
+	if got := do("SET", "order", "100"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("EXISTS", "order"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("EXISTS", "order"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if n := store.lookups.Load(); n != 2 {
+		t.Fatalf("expect 2 lookups, got %d", n)
+	}
+
+	// the key is looked up again after the interval
+	time.Sleep(60 * time.Millisecond)
+	if got := do("EXISTS", "order"); got != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if n := store.lookups.Load(); n != 3 {
+		t.Fatalf("expect 3 lookups, got %d", n)
+	}
+}
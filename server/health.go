@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	LivenessPath  = "/livez"
+	ReadinessPath = "/readyz"
+
+	HealthOK   = "ok"
+	HealthFail = "fail"
+
+	// the timeout of the storage ping of a readiness check and of a warm-up
+	HealthTimeout = 2 * time.Second
+	// the interval to warm up the cold keys again
+	WarmInterval = 5 * time.Second
+)
+
+// HealthCheck is one check of the readiness
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is the liveness or the readiness of the server
+type Health struct {
+	Status string         `json:"status"`
+	Checks []*HealthCheck `json:"checks,omitempty"`
+}
+
+func (h *Health) OK() bool {
+	return h.Status == HealthOK
+}
+
+// failed returns the failed checks as "name:detail" joined by ", "
+func (h *Health) failed() string {
+	var failed []string
+	for _, c := range h.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name+":"+c.Detail)
+		}
+	}
+	return strings.Join(failed, ", ")
+}
+
+// failedNames returns the names of the failed checks joined by ", ", the
+// details are not shown to the unauthenticated clients.
+func (h *Health) failedNames() string {
+	var failed []string
+	for _, c := range h.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	return strings.Join(failed, ", ")
+}
+
+// public returns h without the details of the checks
+func (h *Health) public() *Health {
+	p := &Health{Status: h.Status}
+	for _, c := range h.Checks {
+		p.Checks = append(p.Checks, &HealthCheck{Name: c.Name, OK: c.OK})
+	}
+	return p
+}
+
+func newHealth(checks ...*HealthCheck) *Health {
+	h := &Health{Status: HealthOK, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			h.Status = HealthFail
+		}
+	}
+	return h
+}
+
+// Live returns ok until the server is closed
+func (s *Server) Live() *Health {
+	if s.closed.Load() {
+		return newHealth(&HealthCheck{Name: "server", Detail: "closed"})
+	}
+	return newHealth()
+}
+
+// Ready returns ok if the server can issue ids: Init has completed, the
+// storage is reachable, the circuit breaker is not open and the keys
+// warmed up at startup have a segment. It fetches no segment, the cold keys
+// are warmed up by warmLoop.
+func (s *Server) Ready(ctx context.Context) *Health {
+	if s.closed.Load() {
+		return newHealth(&HealthCheck{Name: "server", Detail: "closed"})
+	}
+	ctx, cancel := context.WithTimeout(ctx, HealthTimeout)
+	defer cancel()
+
+	initCheck := &HealthCheck{Name: "init", OK: s.initialized.Load()}
+	if !initCheck.OK {
+		initCheck.Detail = "not completed"
+	}
+	storageCheck := &HealthCheck{Name: "storage", OK: true}
+	if err := pingStore(ctx, s.store); err != nil {
+		storageCheck.OK = false
+		storageCheck.Detail = err.Error()
+	}
+	breakerCheck := &HealthCheck{Name: "breaker", OK: true}
+	if open := s.fetcher.openBreakers(); len(open) != 0 {
+		backends := make([]string, 0, len(open))
+		for backend, wait := range open {
+			backends = append(backends, fmt.Sprintf("%s open, retry in %v", backend, wait.Round(time.Millisecond)))
+		}
+		sort.Strings(backends)
+		breakerCheck.OK = false
+		breakerCheck.Detail = strings.Join(backends, "; ")
+	}
+	segmentsCheck := &HealthCheck{Name: "segments", OK: true}
+	if cold := s.coldKeyCount(); cold != 0 {
+		segmentsCheck.OK = false
+		segmentsCheck.Detail = fmt.Sprintf("%d keys are cold", cold)
+	}
+	return newHealth(initCheck, storageCheck, breakerCheck, segmentsCheck)
+}
+
+// pingStore checks store is reachable
+func pingStore(ctx context.Context, store SegmentStore) error {
+	if p, ok := store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	_, err := store.Keys()
+	return err
+}
+
+// warmSegments fetches a segment of every key, the keys failed are kept
+// cold and warmed up again by warmLoop.
+func (s *Server) warmSegments() {
+	s.Lock()
+	idgens := make(map[string]*IdGenerator, len(s.keyGeneratorMap))
+	for key, idgen := range s.keyGeneratorMap {
+		idgens[key] = idgen
+	}
+	s.Unlock()
+
+	cold := make(map[string]bool)
+	for key, idgen := range idgens {
+		if err := idgen.Warm(context.Background()); err != nil {
+			logger.Warn("warm up key error",
+				"key", key,
+				"err", err,
+			)
+			cold[key] = true
+		}
+	}
+	s.coldLock.Lock()
+	s.coldKeys = cold
+	s.coldLock.Unlock()
+	logger.Info("segments warmed up",
+		"keys", len(idgens),
+		"cold", len(cold),
+	)
+	if len(cold) != 0 {
+		go s.warmLoop()
+	}
+}
+
+// warmLoop warms up the cold keys every WarmInterval, until no key is cold
+// or the server is closed. The keys of a backend whose breaker is open
+// fail fast.
+func (s *Server) warmLoop() {
+	ticker := time.NewTicker(WarmInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.closed.Load() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), HealthTimeout)
+		cold := s.warmColdKeys(ctx)
+		cancel()
+		if len(cold) == 0 {
+			logger.Info("cold keys warmed up")
+			return
+		}
+	}
+}
+
+// warmColdKeys warms up the cold keys again, it returns the keys still cold
+func (s *Server) warmColdKeys(ctx context.Context) []string {
+	s.coldLock.Lock()
+	keys := make([]string, 0, len(s.coldKeys))
+	for key := range s.coldKeys {
+		keys = append(keys, key)
+	}
+	s.coldLock.Unlock()
+
+	var cold, warm []string
+	for _, key := range keys {
+		s.RLock()
+		idgen, ok := s.keyGeneratorMap[key]
+		s.RUnlock()
+		if ok {
+			if err := idgen.Warm(ctx); err != nil {
+				cold = append(cold, key)
+				continue
+			}
+		}
+		// the key is warm, or deleted
+		warm = append(warm, key)
+	}
+
+	s.coldLock.Lock()
+	for _, key := range warm {
+		delete(s.coldKeys, key)
+	}
+	s.coldLock.Unlock()
+	sort.Strings(cold)
+	return cold
+}
+
+func (s *Server) coldKeyCount() int {
+	s.coldLock.Lock()
+	defer s.coldLock.Unlock()
+	return len(s.coldKeys)
+}
+
+// writeHealth writes h without the details, the http clients are not
+// authenticated.
+func writeHealth(w http.ResponseWriter, h *Health) {
+	h = h.public()
+	w.Header().Set("Content-Type", "application/json")
+	if !h.OK() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// serveHealth serves the liveness and the readiness on addr, apart from the
+// metrics so the probes can be exposed without the metrics.
+func (s *Server) serveHealth(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, s.serveLiveness)
+	mux.HandleFunc(ReadinessPath, s.serveReadiness)
+	s.healthServer = &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go s.healthServer.Serve(ln)
+
+	logger.Info("health running",
+		"address", addr,
+	)
+	return nil
+}
+
+func (s *Server) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.Live())
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.Ready(r.Context()))
+}
+
+// redis command(health [live|ready]), the default is ready. It replies OK,
+// or an error of the failed checks. It needs no authentication, the details
+// of the checks are only shown to the authenticated clients.
+func (s *Server) handleHealth(r *Request) Reply {
+	if len(r.Arguments) > 1 {
+		return ErrTooMuchArgs
+	}
+	probe := "READY"
+	if r.HasArgument(0) {
+		probe = strings.ToUpper(string(r.Arguments[0]))
+	}
+	var h *Health
+	switch probe {
+	case "LIVE":
+		h = s.Live()
+	case "READY":
+		h = s.Ready(r.Context())
+	default:
+		return ErrMethodNotSupported
+	}
+	if !h.OK() {
+		failed := h.failedNames()
+		if s.currentACL() == nil || r.Client != nil && r.Client.User != nil {
+			failed = h.failed()
+		}
+		return &ErrorReply{
+			message: "not " + strings.ToLower(probe) + " " + failed,
+		}
+	}
+	return &StatusReply{
+		code: "OK",
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestReady(t *testing.T) {
+	s := newTestServer(t)
+	store := &outageStore{SegmentStore: s.store}
+	s.store = store
+	s.cfg = &config.Config{WarmSegments: true}
+	s.fetcher = NewFetcher(&config.FetchConfig{Retries: -1, BreakerFailures: 1, BreakerCooldown: 60000})
+	now := time.Now()
+	s.fetcher.now = func() time.Time { return now }
+	store.Reset("order", 0, false)
+
+	do := func(args ...string) string {
+		return replyString(t, s.ServeRequest(newTestRequest("HEALTH", args...)))
+	}
+	if got := do(); got != "-ERR not ready init:not completed\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := do("LIVE"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the warm-up fails, the breaker opens
+	store.err = io.ErrUnexpectedEOF
+	if err := s.Init(); err != nil {
+		t.Fatal(err.Error())
+	}
+	h := s.Ready(context.Background())
+	if h.OK() || h.failed() != "breaker:default open, retry in 1m0s, segments:1 keys are cold" {
+		t.Fatalf("unexpected health %q", h.failed())
+	}
+	rec := httptest.NewRecorder()
+	s.serveReadiness(rec, httptest.NewRequest("GET", ReadinessPath, nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"status":"fail"`) || strings.Contains(rec.Body.String(), "detail") {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the readiness checks do not fetch segments
+	store.err = nil
+	now = now.Add(time.Minute)
+	if got := do("READY"); got != "-ERR not ready segments:1 keys are cold\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if cur, _ := store.Current("order"); cur != 0 {
+		t.Fatalf("expect high-water mark 0, got %d", cur)
+	}
+
+	// the storage is back and the cooldown is over, the key is warmed up
+	if cold := s.warmColdKeys(context.Background()); len(cold) != 0 {
+		t.Fatalf("unexpected cold keys %v", cold)
+	}
+	if got := do("READY"); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if cur, _ := store.Current("order"); cur != BatchCount {
+		t.Fatalf("expect high-water mark %d, got %d", BatchCount, cur)
+	}
+	rec = httptest.NewRecorder()
+	s.serveReadiness(rec, httptest.NewRequest("GET", ReadinessPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	s.closed.Store(true)
+	if got := do("LIVE"); got != "-ERR not live server:closed\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestHealthWithoutAuth(t *testing.T) {
+	s := newTestServer(t)
+	acl, err := NewACL([]*config.UserConfig{{Name: "admin", Password: "secret", Commands: []string{"read"}, Keys: []string{"*"}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.acl = acl
+	limiter, err := NewLimiter([]*config.RateLimitConfig{{Client: "*", Rate: 0.001, Burst: 2}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.limiter = limiter
+	if got := replyString(t, s.ServeRequest(newTestRequest("HEALTH", "LIVE"))); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// the details of the checks are not shown without AUTH
+	if got := replyString(t, s.ServeRequest(newTestRequest("HEALTH"))); got != "-ERR not ready init\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// HEALTH is rate limited like the other commands
+	if got := replyString(t, s.ServeRequest(newTestRequest("HEALTH"))); got != "-ERR rate limit exceeded for the client\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := replyString(t, s.ServeRequest(newTestRequest("INFO"))); got[0] != '-' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.serveHealth("127.0.0.1:0"); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.healthServer.Close()
+
+	for path, code := range map[string]int{
+		LivenessPath:  http.StatusOK,
+		ReadinessPath: http.StatusServiceUnavailable,
+		MetricsPath:   http.StatusNotFound,
+	} {
+		resp, err := http.Get("http://" + s.healthServer.Addr + path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%s: expect %d, got %d", path, code, resp.StatusCode)
+		}
+	}
+	if _, err := NewServer(&config.Config{MetricsAddr: "127.0.0.1:9389", HealthAddr: "127.0.0.1:9389"}); err == nil || !strings.HasPrefix(err.Error(), "health_addr") {
+		t.Fatalf("expect error of health_addr same as metrics_addr, got %v", err)
+	}
+}
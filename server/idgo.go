@@ -1,51 +1,51 @@
 package server
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	// create key table
-	CreateTableSQLFormat = `
-	CREATE TABLE %s (
-    id bigint(20) unsigned NOT NULL auto_increment,
-    PRIMARY KEY  (id)
-) ENGINE=Innodb DEFAULT CHARSET=utf8 `
-
-	// create key table if not exist
-	CreateTableNTSQLFormat = `
-	CREATE TABLE IF NOT EXISTS %s (
-    id bigint(20) unsigned NOT NULL auto_increment,
-    PRIMARY KEY  (id)
-) ENGINE=Innodb DEFAULT CHARSET=utf8 `
-
-	DropTableSQLFormat   = `DROP TABLE IF EXISTS %s`
-	InsertIdSQLFormat    = "INSERT INTO %s(id) VALUES(%d)"
-	SelectForUpdate      = "SELECT id FROM %s FOR UPDATE"
-	UpdateIdSQLFormat    = "UPDATE %s SET id = id + %d"
-	GetRowCountSQLFormat = "SELECT count(*) FROM %s"
-	GetKeySQLFormat      = "show tables like '%s'"
-
 	BatchCount = 2000
+	MaxStep    = 100000000
 )
 
-type MySQLIdGenerator struct {
-	db       *sql.DB
-	key      string // id generator key name
-	cur      int64  // current id
-	batchMax int64  // max id till get from mysql
-	batch    int64  // get batch count ids from mysql once
+// IdGenerator hands out ids from the segment cached in memory, and fetches
+// a new segment of batch ids from the SegmentStore when the segment is used up.
+type IdGenerator struct {
+	store    SegmentStore
+	key      string   // id generator key name
+	cur      int64    // current id
+	batchMax int64    // max id till get from store
+	batch    int64    // get batch count ids from store once
+	fetcher  *Fetcher // fetch with retries and circuit breaker, nil fetches directly
+
+	// the reserve of reserve ids is fetched with the first segment, and only
+	// issued while the storage is unavailable. The ids used are fetched again
+	// with the next segment after the storage recovers.
+	reserve     int64
+	reserves    []idRange
+	degraded    atomic.Bool  // the ids are issued from the reserve
+	reserveLeft atomic.Int64 // read by INFO without the lock
+
+	// the generation of the key in the store when the segment was fetched,
+	// it is checked every checkInterval before issuing an id, 0 never checks
+	generation    int64
+	checkInterval time.Duration
+	checkedAt     atomic.Int64 // unix nanosecond of the last read of the generation
 
 	lock sync.Mutex
 }
 
-func NewMySQLIdGenerator(db *sql.DB, section string, batchCount int64) (*MySQLIdGenerator, error) {
-	idGenerator := new(MySQLIdGenerator)
-	idGenerator.db = db
+func NewIdGenerator(store SegmentStore, section string, batchCount int64) (*IdGenerator, error) {
+	idGenerator := new(IdGenerator)
+	idGenerator.store = store
 	if len(section) == 0 {
 		return nil, fmt.Errorf("section is nil")
 	}
@@ -65,176 +65,172 @@ func NewMySQLIdGenerator(db *sql.DB, section string, batchCount int64) (*MySQLId
 	return idGenerator, nil
 }
 
-func (m *MySQLIdGenerator) SetSection(key string) error {
+func (m *IdGenerator) SetSection(key string) error {
 	m.key = key
 	return nil
 }
 
-// get id from key table
-func (m *MySQLIdGenerator) getIdFromMySQL() (int64, error) {
-	var id int64
-	selectForUpdate := fmt.Sprintf(SelectForUpdate, m.key)
-	tx, err := m.db.Begin()
-	if err != nil {
-		return 0, err
-	}
+// get current id
+func (m *IdGenerator) Current() (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	rows, err := tx.Query(selectForUpdate)
-	if err != nil {
-		tx.Rollback()
-		return 0, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		err := rows.Scan(&id)
-		if err != nil {
-			tx.Rollback()
-			return 0, err
-		}
-	}
-	tx.Commit()
+	return m.cur, nil
+}
+
+// Segment returns the last id issued, the max id of the cached segment and
+// the batch count.
+func (m *IdGenerator) Segment() (int64, int64, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	return id, nil
+	return m.cur, m.batchMax, m.batch
 }
 
-// get current id
-func (m *MySQLIdGenerator) Current() (int64, error) {
+// SetBatch sets the batch count of the next segments
+func (m *IdGenerator) SetBatch(batch int64) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	return m.cur, nil
+	m.batch = batch
 }
 
-func (m *MySQLIdGenerator) Next() (int64, error) {
-	var id int64
-	var haveValue bool
-	selectForUpdate := fmt.Sprintf(SelectForUpdate, m.key)
-	updateIdSql := fmt.Sprintf(UpdateIdSQLFormat, m.key, m.batch)
+func (m *IdGenerator) Next() (int64, error) {
+	return m.NextContext(context.Background())
+}
+
+// NextContext is Next with the spans of lock wait and segment fetch
+// as children of the span in ctx.
+func (m *IdGenerator) NextContext(ctx context.Context) (int64, error) {
+	generation, polled := m.pollGeneration()
+	_, lockSpan := tracer.Start(ctx, "IdGenerator.lock")
+	lockStart := time.Now()
 	m.lock.Lock()
+	addLockWait(ctx, time.Since(lockStart))
+	lockSpan.End()
 	defer m.lock.Unlock()
+	if polled && m.batchMax >= m.cur+1 && !m.degraded.Load() {
+		m.checkGeneration(generation)
+	}
 	if m.batchMax < m.cur+1 {
-		tx, err := m.db.Begin()
-		if err != nil {
-			return 0, err
-		}
-
-		rows, err := tx.Query(selectForUpdate)
-		if err != nil {
-			tx.Rollback()
-			return 0, err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			err := rows.Scan(&id)
-			if err != nil {
-				tx.Rollback()
-				return 0, err
-			}
-			haveValue = true
-		}
-		// When the idgo table has no id key
-		if haveValue == false {
-			return 0, fmt.Errorf("%s:have no id key", m.key)
-		}
-		_, err = tx.Exec(updateIdSql)
-		if err != nil {
-			tx.Rollback()
+		if err := m.loadSegment(ctx); err != nil && !m.useReserve(ctx, err) {
 			return 0, err
 		}
-		tx.Commit()
-
-		// batchMax is larger than cur BatchCount
-		m.batchMax = id + BatchCount
-		m.cur = id
 	}
 	m.cur++
+	idsIssued.WithLabelValues(m.key).Inc()
+	segmentRemaining.WithLabelValues(m.key).Set(float64(m.batchMax - m.cur))
 	return m.cur, nil
 }
 
-func (m *MySQLIdGenerator) Init() error {
-	var err error
-
+// Warm fetches a segment if the cached segment is used up, no id is issued.
+func (m *IdGenerator) Warm(ctx context.Context) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	m.cur, err = m.getIdFromMySQL()
+	if m.batchMax > m.cur {
+		return nil
+	}
+	return m.loadSegment(ctx)
+}
+
+// loadSegment fetches a new segment from the store, it must be called
+// with the lock.
+func (m *IdGenerator) loadSegment(ctx context.Context) error {
+	need := m.reserveNeed()
+	fetchCtx, span := tracer.Start(ctx, "SegmentStore.Fetch", trace.WithAttributes(
+		keyAttribute(m.key),
+		attribute.Int64("idgo.batch", m.batch+need),
+	))
+	start := time.Now()
+	generation, err := m.readGeneration()
+	var id int64
+	if err == nil {
+		id, err = m.fetch(fetchCtx, m.batch+need)
+	}
+	fetchTime := time.Since(start)
+	addStorageTime(ctx, fetchTime)
+	segmentFetchDuration.Observe(fetchTime.Seconds())
+	segmentFetches.WithLabelValues(m.key).Inc()
+	endSpan(span, err)
 	if err != nil {
+		segmentFetchErrors.WithLabelValues(m.key).Inc()
 		return err
 	}
-	m.batchMax = m.cur
+
+	// batchMax is larger than cur batch count
+	m.batchMax = id + m.batch
+	m.cur = id
+	m.generation = generation
+	m.refillReserve(m.batchMax, need)
 	return nil
 }
 
-// if force is true, create table directly
-// if force is false, create table use CreateTableNTSQLFormat
-func (m *MySQLIdGenerator) Reset(idOffset int64, force bool) error {
+func (m *IdGenerator) fetch(ctx context.Context, step int64) (int64, error) {
+	if m.fetcher == nil {
+		return fetchContext(ctx, m.store, m.key, step)
+	}
+	return m.fetcher.Fetch(ctx, m.store, m.key, step)
+}
+
+func (m *IdGenerator) Init() error {
 	var err error
-	createTableSQL := fmt.Sprintf(CreateTableSQLFormat, m.key)
-	createTableNtSQL := fmt.Sprintf(CreateTableNTSQLFormat, m.key)
-	dropTableSQL := fmt.Sprintf(DropTableSQLFormat, m.key)
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	if force == true {
-		_, err = m.db.Exec(dropTableSQL)
-		if err != nil {
-			return err
-		}
-		_, err = m.db.Exec(createTableSQL)
-		if err != nil {
-			return err
-		}
-	} else {
-		var rowCount int64
-		_, err = m.db.Exec(createTableNtSQL)
-		if err != nil {
-			return err
-		}
-		// check the idgo value if exist
-		getRowCountSQL := fmt.Sprintf(GetRowCountSQLFormat, m.key)
-		rows, err := m.db.Query(getRowCountSQL)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			err := rows.Scan(&rowCount)
-			if err != nil {
-				return err
-			}
-		}
-
-		if rowCount == int64(1) {
-			m.cur, err = m.getIdFromMySQL()
-			if err != nil {
-				return err
-			}
-			m.batchMax = m.cur
-			return nil
-		}
-	}
-
-	insertIdSQL := fmt.Sprintf(InsertIdSQLFormat, m.key, idOffset)
-	_, err = m.db.Exec(insertIdSQL)
+	m.cur, err = m.store.Current(m.key)
 	if err != nil {
-		m.db.Exec(dropTableSQL)
 		return err
 	}
-	m.cur = idOffset
 	m.batchMax = m.cur
+	m.clearReserve()
 	return nil
 }
 
-func (m *MySQLIdGenerator) DelKeyTable(key string) error {
-	dropTableSQL := fmt.Sprintf(DropTableSQLFormat, key)
+// if force is true, the value of key is overwritten by idOffset
+// if force is false, the value of key is kept when it exists
+func (m *IdGenerator) Reset(idOffset int64, force bool) error {
+	return m.ResetContext(context.Background(), idOffset, force)
+}
 
+func (m *IdGenerator) ResetContext(ctx context.Context, idOffset int64, force bool) error {
+	_, lockSpan := tracer.Start(ctx, "IdGenerator.lock")
+	lockStart := time.Now()
 	m.lock.Lock()
+	addLockWait(ctx, time.Since(lockStart))
+	lockSpan.End()
 	defer m.lock.Unlock()
 
-	_, err := m.db.Exec(dropTableSQL)
+	_, span := tracer.Start(ctx, "SegmentStore.Reset", trace.WithAttributes(
+		keyAttribute(m.key),
+		attribute.Int64("idgo.value", idOffset),
+		attribute.Bool("idgo.force", force),
+	))
+	start := time.Now()
+	id, err := m.store.Reset(m.key, idOffset, force)
+	addStorageTime(ctx, time.Since(start))
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
+	m.cur = id
+	m.batchMax = m.cur
+	m.clearReserve()
+	// the value is kept without force, the segments of the other
+	// instances are still valid
+	if force {
+		return bumpGeneration(m.store, m.key)
+	}
 	return nil
 }
+
+func (m *IdGenerator) Del() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.store.Delete(m.key); err != nil {
+		return err
+	}
+	return bumpGeneration(m.store, m.key)
+}
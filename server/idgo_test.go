@@ -3,25 +3,59 @@ package server
 import (
 	"database/sql"
 	"fmt"
+	"path/filepath"
 	"sync"
 	"testing"
 
 	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/flike/idgo/config"
 )
 
 var wg sync.WaitGroup
-var db *sql.DB
 
-func init() {
-	var err error
+// the generator tests run against every store, the mysql store is
+// skipped when there is no mysql at 127.0.0.1:3306
+var testStores = []struct {
+	name string
+	open func(tb testing.TB) SegmentStore
+}{
+	{StorageSQLite, openTestSQLiteStore},
+	{StorageMySQL, openTestMySQLStore},
+}
+
+func openTestSQLiteStore(tb testing.TB) SegmentStore {
+	store, err := NewSQLiteStore(&config.SQLiteConfig{
+		Path: filepath.Join(tb.TempDir(), "idgo.db"),
+	})
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	if err = store.Init(); err != nil {
+		tb.Fatal(err.Error())
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
 
-	db, err = sql.Open("mysql", "root:@tcp(127.0.0.1:3306)/test?charset=utf8")
+func openTestMySQLStore(tb testing.TB) SegmentStore {
+	db, err := sql.Open("mysql", "root:@tcp(127.0.0.1:3306)/test?charset=utf8")
 	if err != nil {
-		fmt.Println(err.Error())
+		tb.Fatal(err.Error())
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		tb.Skip(err.Error())
+	}
+	store := &MySQLStore{db: db}
+	if err = store.Init(); err != nil {
+		tb.Fatal(err.Error())
 	}
+	tb.Cleanup(func() { store.Close() })
+	return store
 }
 
-func GetId(idGenerator *MySQLIdGenerator) {
+func GetId(idGenerator *IdGenerator) {
 	defer wg.Done()
 	for i := 0; i < 100; i++ {
 		_, err := idGenerator.Next()
@@ -31,45 +65,104 @@ func GetId(idGenerator *MySQLIdGenerator) {
 	}
 }
 
-func TestMySQLIdgen(t *testing.T) {
-	idGenerator, err := NewMySQLIdGenerator(db, "mysql_victory", BatchCount)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
-	err = idGenerator.Reset(1, false)
-	if err != nil {
-		t.Fatal(err.Error())
+func TestIdgen(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.name, func(t *testing.T) {
+			store := ts.open(t)
+			idGenerator, err := NewIdGenerator(store, ts.name+"_victory", BatchCount)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			err = idGenerator.Reset(1, true)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			// 10 goroutine
+			wg.Add(10)
+			for i := 0; i < 10; i++ {
+				go GetId(idGenerator)
+			}
+			wg.Wait()
+			id, err := idGenerator.Next()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if id != 1002 {
+				t.Fatalf("expect 1002, got %d", id)
+			}
+		})
 	}
-	// 10 goroutine
-	wg.Add(10)
-	for i := 0; i < 10; i++ {
-		go GetId(idGenerator)
-	}
-	wg.Wait()
-	id, err := idGenerator.Next()
-	if err != nil {
-		t.Fatal(err.Error())
-	}
-	t.Log(id)
 }
 
-func BenchmarkMySQLIdgen(b *testing.B) {
-	idGenerator, err := NewMySQLIdGenerator(db, "mysql_file", BatchCount)
-	if err != nil {
-		b.Fatal(err.Error())
-	}
-	err = idGenerator.Reset(1, false)
-	if err != nil {
-		b.Fatal(err.Error())
-	}
+func TestIdgenSegment(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.name, func(t *testing.T) {
+			store := ts.open(t)
+			key := ts.name + "_segment"
+			a, _ := NewIdGenerator(store, key, 10)
+			b, _ := NewIdGenerator(store, key, 10)
+			if err := a.Reset(100, true); err != nil {
+				t.Fatal(err.Error())
+			}
+			// the existing value is kept when force is false
+			if err := b.Reset(0, false); err != nil {
+				t.Fatal(err.Error())
+			}
+			ids := make(map[int64]bool)
+			for i := 0; i < 25; i++ {
+				for _, g := range []*IdGenerator{a, b} {
+					id, err := g.Next()
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if id <= 100 || ids[id] {
+						t.Fatalf("unexpected id %d", id)
+					}
+					ids[id] = true
+				}
+			}
 
-	b.StartTimer()
-	for i := 0; i < 1000; i++ {
-		_, err = idGenerator.Next()
-		if err != nil {
-			b.Fatal(err.Error())
-		}
+			keys, err := store.Keys()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			found := false
+			for _, k := range keys {
+				found = found || k == key
+			}
+			if !found {
+				t.Fatalf("%s not in keys %v", key, keys)
+			}
+			if err = a.Del(); err != nil {
+				t.Fatal(err.Error())
+			}
+			if exist, _ := store.IsKeyExist(key); exist {
+				t.Fatal("key should be deleted")
+			}
+		})
 	}
+}
+
+func BenchmarkIdgen(b *testing.B) {
+	for _, ts := range testStores {
+		b.Run(ts.name, func(b *testing.B) {
+			store := ts.open(b)
+			idGenerator, err := NewIdGenerator(store, ts.name+"_file", BatchCount)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+			err = idGenerator.Reset(1, false)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
 
-	b.StopTimer()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = idGenerator.Next()
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
 }
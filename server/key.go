@@ -0,0 +1,33 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// the max length of a key sent by the client, without the namespace prefix
+	MaxKeyLength = 64
+	// the keys with this prefix are reserved by idgo, such as __idgo__
+	ReservedKeyPrefix = "__"
+)
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.:-]*$`)
+
+// IsValidKey checks the key name, a key is 1 to MaxKeyLength letters,
+// digits or any of "_.:-", and does not start with '.', ':', '-'
+// or ReservedKeyPrefix.
+func IsValidKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	if strings.HasPrefix(key, ReservedKeyPrefix) {
+		return false
+	}
+	return keyPattern.MatchString(key)
+}
+
+// quoteIdentifier quotes a MySQL identifier with backticks
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// logger is the logger of the server, it can be replaced by SetLogger
+// with a logger of any slog.Handler.
+var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+// logLevel is the level of the loggers created by NewLogger, it is changed
+// by SetLogLevel.
+var logLevel = new(slog.LevelVar)
+
+// the ids of the connections and the requests, they are unique in the process
+var (
+	connIDs    atomic.Uint64
+	requestIDs atomic.Uint64
+)
+
+// SetLogger sets the logger of the server, it should be called before
+// NewServer.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// SetLogLevel sets the level of the loggers created by NewLogger.
+func SetLogLevel(level string) error {
+	if err := checkLogLevel(level); err != nil {
+		return err
+	}
+	logLevel.Set(ParseLogLevel(level))
+	return nil
+}
+
+func checkLogLevel(level string) error {
+	switch strings.ToLower(level) {
+	case "", "debug", "info", "warn", "error":
+		return nil
+	}
+	return fmt.Errorf("log:%s:invalid log_level", level)
+}
+
+// ParseLogLevel parses debug|info|warn|error, the default is error.
+func ParseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// NewLogger creates a logger writing lines of format(json|logfmt) to w,
+// level sets the level shared by the loggers created by NewLogger.
+func NewLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	logLevel.Set(ParseLogLevel(level))
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+	switch strings.ToLower(format) {
+	case "", LogFormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("log:%s:invalid log_format", format)
+	}
+}
+
+// logger returns the logger with the ids of the request and its connection
+func (r *Request) logger() *slog.Logger {
+	if r.Client != nil && r.Client.log != nil {
+		return r.Client.log.With("req_id", r.ID)
+	}
+	return logger.With("req_id", r.ID, "client", r.RemoteAddress)
+}
+
+// logRequest logs a line of the served request, the failed requests are
+// logged at info level and the others at debug level.
+func logRequest(r *Request, reply Reply, latency time.Duration) {
+	level := slog.LevelDebug
+	if _, ok := reply.(*ErrorReply); ok {
+		level = slog.LevelInfo
+	}
+	if !logger.Enabled(r.Context(), level) {
+		return
+	}
+	attrs := []any{"command", r.Command}
+	if cc, ok := commandClasses[r.Command]; ok && cc.hasKey && r.HasArgument(0) {
+		attrs = append(attrs, "key", string(r.Arguments[0]))
+	}
+	attrs = append(attrs, "latency", latency)
+	if errReply, ok := reply.(*ErrorReply); ok {
+		attrs = append(attrs, "err", errReply.message)
+	}
+	r.logger().Log(r.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "xml", "debug"); err == nil {
+		t.Fatal("expect invalid log_format error")
+	}
+
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, LogFormatLogfmt, "warn")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l.Info("hidden")
+	l.Warn("shown", "key", "a b")
+	if got := buf.String(); strings.Contains(got, "hidden") || !strings.Contains(got, `msg=shown key="a b"`) {
+		t.Fatalf("unexpected logfmt line %q", got)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, LogFormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	old := logger
+	SetLogger(l)
+	defer SetLogger(old)
+
+	s := newTestServer(t)
+	client := &Client{ID: 7, RemoteAddress: "127.0.0.1:5000"}
+	client.log = logger.With("conn_id", client.ID, "client", client.RemoteAddress)
+	for _, r := range []*Request{
+		newTestRequest("SET", "log_key", "10"),
+		newTestRequest("GET", "log_key"),
+		newTestRequest("GET", "bad key"),
+	} {
+		r.Client = client
+		s.ServeRequest(r)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines, got %q", buf.String())
+	}
+	var ids []float64
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err.Error())
+		}
+		if entry["msg"] != "request" || entry["conn_id"] != float64(7) ||
+			entry["client"] != "127.0.0.1:5000" || entry["latency"] == nil {
+			t.Fatalf("unexpected line %q", line)
+		}
+		ids = append(ids, entry["req_id"].(float64))
+		if i == 1 && (entry["command"] != "GET" || entry["key"] != "log_key" || entry["level"] != "DEBUG") {
+			t.Fatalf("unexpected line %q", line)
+		}
+		if i == 2 && (entry["level"] != "INFO" || entry["err"] != "invalid key") {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatalf("expect different request ids, got %v", ids)
+	}
+}
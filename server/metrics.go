@@ -0,0 +1,212 @@
+package server
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	MetricsNamespace = "idgo"
+	MetricsPath      = "/metrics"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "commands_total",
+		Help:      "Number of commands processed.",
+	}, []string{"command"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Latency of commands.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 10),
+	}, []string{"command"})
+
+	idsIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ids_issued_total",
+		Help:      "Number of ids issued of the key.",
+	}, []string{"key"})
+	segmentRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_remaining",
+		Help:      "Number of ids remaining in the segment of the key.",
+	}, []string{"key"})
+
+	segmentFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_fetches_total",
+		Help:      "Number of segments fetched from storage.",
+	}, []string{"key"})
+	segmentFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_fetch_errors_total",
+		Help:      "Number of failed segment fetches from storage.",
+	}, []string{"key"})
+	segmentFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_fetch_duration_seconds",
+		Help:      "Latency of segment fetches from storage.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	segmentFetchRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_fetch_retries_total",
+		Help:      "Number of segment fetches retried after a retryable error.",
+	})
+	segmentFetchTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "segment_fetch_timeouts_total",
+		Help:      "Number of segment fetches aborted by the fetch timeout.",
+	})
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "storage_breaker_state",
+		Help:      "State of the circuit breaker of a storage backend, 0 closed, 1 open, 2 half-open.",
+	}, []string{"backend"})
+	breakerRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "storage_breaker_rejected_total",
+		Help:      "Number of segment fetches failed fast by the open circuit breaker.",
+	})
+	keyDegraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "key_degraded",
+		Help:      "1 if the ids of the key are issued from the reserve.",
+	}, []string{"key"})
+	reserveRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "reserve_remaining",
+		Help:      "Number of ids left in the reserve of the key.",
+	}, []string{"key"})
+	staleSegments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "stale_segments_total",
+		Help:      "Number of segments dropped after the key was reset or deleted by another instance.",
+	}, []string{"key"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected by the rate limits and quotas.",
+	}, []string{"limit"})
+
+	connectedClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "connected_clients",
+		Help:      "Number of client connections.",
+	})
+	protocolErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "protocol_errors_total",
+		Help:      "Number of malformed requests.",
+	})
+	rejectedConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rejected_connections_total",
+		Help:      "Number of connections rejected by maxclients.",
+	})
+	requestLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "request_limits_exceeded_total",
+		Help:      "Number of requests over the argument count or bulk length limits.",
+	}, []string{"limit"})
+	connectionTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "connection_timeouts_total",
+		Help:      "Number of connections closed by the idle, read or write timeouts.",
+	}, []string{"timeout"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		commandsTotal,
+		commandDuration,
+		idsIssued,
+		segmentRemaining,
+		segmentFetches,
+		segmentFetchErrors,
+		segmentFetchDuration,
+		segmentFetchRetries,
+		segmentFetchTimeouts,
+		breakerState,
+		breakerRejected,
+		keyDegraded,
+		reserveRemaining,
+		staleSegments,
+		rateLimited,
+		connectedClients,
+		protocolErrors,
+		rejectedConnections,
+		requestLimitsExceeded,
+		connectionTimeouts,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// commandLabel bounds the command label to the supported commands
+func commandLabel(command string) string {
+	switch command {
+	case "GET", "SET", "EXISTS", "DEL", "SELECT", "AUTH", "ACL", "AUDIT", "SLOWLOG", "MONITOR", "INFO", "KEYS", "DESCRIBE", "CONFIG", "HEALTH":
+		return command
+	default:
+		return "unknown"
+	}
+}
+
+// deleteKeyMetrics removes the metrics of a deleted key
+func deleteKeyMetrics(key string) {
+	idsIssued.DeleteLabelValues(key)
+	segmentRemaining.DeleteLabelValues(key)
+	segmentFetches.DeleteLabelValues(key)
+	segmentFetchErrors.DeleteLabelValues(key)
+	keyDegraded.DeleteLabelValues(key)
+	reserveRemaining.DeleteLabelValues(key)
+	staleSegments.DeleteLabelValues(key)
+}
+
+// DBStore is implemented by the stores on database/sql,
+// DBs returns the databases by name.
+type DBStore interface {
+	DBs() map[string]*sql.DB
+}
+
+// serveMetrics registers the pool stats of the databases and serves
+// the metrics on addr.
+func (s *Server) serveMetrics(addr string) error {
+	if d, ok := s.store.(DBStore); ok {
+		for name, db := range d.DBs() {
+			if err := metricsRegistry.Register(collectors.NewDBStatsCollector(db, name)); err != nil {
+				logger.Warn("register db stats error",
+					"db", name,
+					"err", err,
+				)
+			}
+		}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(LivenessPath, s.serveLiveness)
+	mux.HandleFunc(ReadinessPath, s.serveReadiness)
+	s.httpServer = &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go s.httpServer.Serve(ln)
+
+	logger.Info("metrics running",
+		"address", addr,
+	)
+	return nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	gets := testutil.ToFloat64(commandsTotal.WithLabelValues("GET"))
+	unknown := testutil.ToFloat64(commandsTotal.WithLabelValues("unknown"))
+
+	s.ServeRequest(newTestRequest("SET", "metrics_key", "0"))
+	for i := 0; i < 3; i++ {
+		s.ServeRequest(newTestRequest("GET", "metrics_key"))
+	}
+	s.ServeRequest(newTestRequest("FLUSHALL"))
+
+	if got := testutil.ToFloat64(commandsTotal.WithLabelValues("GET")) - gets; got != 3 {
+		t.Fatalf("expect 3 GET, got %v", got)
+	}
+	if got := testutil.ToFloat64(commandsTotal.WithLabelValues("unknown")) - unknown; got != 1 {
+		t.Fatalf("expect 1 unknown command, got %v", got)
+	}
+	if got := testutil.ToFloat64(idsIssued.WithLabelValues("metrics_key")); got != 3 {
+		t.Fatalf("expect 3 ids issued, got %v", got)
+	}
+	if got := testutil.ToFloat64(segmentRemaining.WithLabelValues("metrics_key")); got != BatchCount-3 {
+		t.Fatalf("expect %d ids remaining, got %v", BatchCount-3, got)
+	}
+	if got := testutil.ToFloat64(segmentFetches.WithLabelValues("metrics_key")); got != 1 {
+		t.Fatalf("expect 1 segment fetch, got %v", got)
+	}
+
+	if err := s.serveMetrics("127.0.0.1:0"); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.httpServer.Close()
+	resp, err := http.Get("http://" + s.httpServer.Addr + MetricsPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, metric := range []string{
+		`idgo_commands_total{command="GET"}`,
+		`idgo_ids_issued_total{key="metrics_key"} 3`,
+		"idgo_segment_fetch_duration_seconds_count",
+		`go_sql_max_open_connections{db_name="sqlite"}`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Fatalf("%s not in metrics", metric)
+		}
+	}
+
+	s.ServeRequest(newTestRequest("DEL", "metrics_key"))
+	if strings.Contains(testGather(t), `key="metrics_key"`) {
+		t.Fatal("metrics of the deleted key should be removed")
+	}
+}
+
+func testGather(t *testing.T) string {
+	mfs, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var b strings.Builder
+	for _, mf := range mfs {
+		b.WriteString(mf.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/flike/idgo/config"
+)
+
+// Master is a database of a ModuloStore. It only issues the segments
+// whose index modulo Stride equals Offset.
+type Master struct {
+	Name   string
+	Store  SegmentStore
+	Offset int64
+	Stride int64
+}
+
+// ModuloStore lets several independent databases issue the ids of the
+// same keys without coordination. The high-water mark of a key in the
+// master with offset o is always at the start of a segment whose index is
+// o modulo stride, and a fetch moves it stride segments forward, so the
+// segments drawn from different masters interleave without collision.
+// When the active master is unreachable, the next one is used.
+type ModuloStore struct {
+	masters []Master
+	batch   int64 // the size of a segment
+
+	lock   sync.Mutex
+	active int
+}
+
+func NewMySQLModuloStore(c *config.MultiMasterConfig) (*ModuloStore, error) {
+	masters := make([]Master, 0, len(c.DBs))
+	for i, dbc := range c.DBs {
+		store, err := NewMySQLStore(&dbc.DBConfig)
+		if err != nil {
+			for _, m := range masters {
+				m.Store.Close()
+			}
+			return nil, err
+		}
+		name := dbc.Name
+		if len(name) == 0 {
+			name = strconv.Itoa(i)
+		}
+		masters = append(masters, Master{
+			Name:   name,
+			Store:  store,
+			Offset: dbc.Offset,
+			Stride: dbc.Stride,
+		})
+	}
+	s, err := NewModuloStore(masters, c.Batch)
+	if err != nil {
+		for _, m := range masters {
+			m.Store.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewModuloStore(masters []Master, batch int64) (*ModuloStore, error) {
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("multi master:have no storage")
+	}
+	if batch <= 0 {
+		batch = BatchCount
+	}
+	stride := masters[0].Stride
+	if stride < int64(len(masters)) {
+		return nil, fmt.Errorf("multi master:stride %d is less than the count of masters %d",
+			stride, len(masters))
+	}
+	offsets := make(map[int64]string)
+	for _, m := range masters {
+		if m.Stride != stride {
+			return nil, fmt.Errorf("multi master %s:stride %d does not match %d", m.Name, m.Stride, stride)
+		}
+		if m.Offset < 0 || m.Offset >= stride {
+			return nil, fmt.Errorf("multi master %s:offset %d out of [0, %d)", m.Name, m.Offset, stride)
+		}
+		if name, ok := offsets[m.Offset]; ok {
+			return nil, fmt.Errorf("multi master %s:offset %d is used by %s", m.Name, m.Offset, name)
+		}
+		offsets[m.Offset] = m.Name
+	}
+	return &ModuloStore{
+		masters: masters,
+		batch:   batch,
+	}, nil
+}
+
+// align returns the smallest segment start of m which is not less than id
+func (s *ModuloStore) align(m *Master, id int64) int64 {
+	round := s.batch * m.Stride
+	start := m.Offset * s.batch
+	if id <= start {
+		return start
+	}
+	n := (id - start + round - 1) / round
+	return start + n*round
+}
+
+// each calls fn on the masters from the active one until fn succeeds
+func (s *ModuloStore) each(op string, key string, fn func(m *Master) error) error {
+	s.lock.Lock()
+	active := s.active
+	s.lock.Unlock()
+
+	var err error
+	for i := 0; i < len(s.masters); i++ {
+		idx := (active + i) % len(s.masters)
+		m := &s.masters[idx]
+		err = fn(m)
+		if err == nil {
+			if idx != active {
+				s.lock.Lock()
+				s.active = idx
+				s.lock.Unlock()
+				logger.Warn("fail over",
+					"op", op,
+					"key", key,
+					"master", m.Name,
+				)
+			}
+			return nil
+		}
+		logger.Error("master error",
+			"op", op,
+			"key", key,
+			"master", m.Name,
+			"err", err,
+		)
+	}
+	return err
+}
+
+// Init inits all the masters, it only fails when no master is available.
+func (s *ModuloStore) Init() error {
+	var ok bool
+	var err error
+	for _, m := range s.masters {
+		if e := m.Store.Init(); e != nil {
+			logger.Error("master error",
+				"op", "Init",
+				"master", m.Name,
+				"err", e,
+			)
+			err = e
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys of all the reachable masters.
+func (s *ModuloStore) Keys() ([]string, error) {
+	var ok bool
+	var err error
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range s.masters {
+		masterKeys, e := m.Store.Keys()
+		if e != nil {
+			err = e
+			continue
+		}
+		ok = true
+		for _, key := range masterKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if !ok {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *ModuloStore) IsKeyExist(key string) (bool, error) {
+	var ok bool
+	var err error
+	for _, m := range s.masters {
+		exist, e := m.Store.IsKeyExist(key)
+		if e != nil {
+			err = e
+			continue
+		}
+		if exist {
+			return true, nil
+		}
+		ok = true
+	}
+	if !ok {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *ModuloStore) Current(key string) (int64, error) {
+	var id int64
+	err := s.each("Current", key, func(m *Master) error {
+		var err error
+		id, err = m.Store.Current(key)
+		return err
+	})
+	return id, err
+}
+
+func (s *ModuloStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+// FetchContext fetches from the masters with ctx, the next master is not
+// tried after ctx is done.
+func (s *ModuloStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	if step != s.batch {
+		return 0, fmt.Errorf("%s:batch %d does not match the multi master batch %d",
+			key, step, s.batch)
+	}
+	var id int64
+	err := s.each("Fetch", key, func(m *Master) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		id, err = fetchContext(ctx, m.Store, key, s.batch*m.Stride)
+		return err
+	})
+	return id, err
+}
+
+// Reset resets key on all the masters, every master starts from its first
+// segment not less than idOffset. It only fails when no master is available.
+func (s *ModuloStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	var id int64
+	var ok bool
+	var err error
+	for i := range s.masters {
+		m := &s.masters[i]
+		v, e := m.Store.Reset(key, s.align(m, idOffset), force)
+		if e != nil {
+			logger.Error("master error",
+				"op", "Reset",
+				"key", key,
+				"master", m.Name,
+				"err", e,
+			)
+			err = e
+			continue
+		}
+		if !ok {
+			id = v
+		}
+		ok = true
+	}
+	if !ok {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *ModuloStore) Delete(key string) error {
+	var err error
+	for _, m := range s.masters {
+		if e := m.Store.Delete(key); e != nil {
+			logger.Error("master error",
+				"op", "Delete",
+				"key", key,
+				"master", m.Name,
+				"err", e,
+			)
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *ModuloStore) BatchSize(key string) int64 {
+	return s.batch
+}
+
+func (s *ModuloStore) DBs() map[string]*sql.DB {
+	dbs := make(map[string]*sql.DB)
+	for _, m := range s.masters {
+		if d, ok := m.Store.(DBStore); ok {
+			for dbName, db := range d.DBs() {
+				dbs[m.Name+"/"+dbName] = db
+			}
+		}
+	}
+	return dbs
+}
+
+// Ping checks one of the masters is reachable
+func (s *ModuloStore) Ping(ctx context.Context) error {
+	var err error
+	for i := range s.masters {
+		m := &s.masters[i]
+		e := pingStore(ctx, m.Store)
+		if e == nil {
+			return nil
+		}
+		err = fmt.Errorf("master %s:%v", m.Name, e)
+	}
+	return err
+}
+
+func (s *ModuloStore) Close() error {
+	var err error
+	for _, m := range s.masters {
+		if e := m.Store.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
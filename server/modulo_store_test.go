@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestModuloStoreInterleave(t *testing.T) {
+	dc1 := openTestSQLiteStore(t)
+	dc2 := openTestSQLiteStore(t)
+	// two idgo instances, each prefers a different database
+	a, err := NewModuloStore([]Master{
+		{Name: "dc1", Store: dc1, Offset: 0, Stride: 2},
+		{Name: "dc2", Store: dc2, Offset: 1, Stride: 2},
+	}, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewModuloStore([]Master{
+		{Name: "dc2", Store: dc2, Offset: 1, Stride: 2},
+		{Name: "dc1", Store: dc1, Offset: 0, Stride: 2},
+	}, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	genA, _ := NewIdGenerator(a, "order", 10)
+	genB, _ := NewIdGenerator(b, "order", 10)
+	if err = genA.Reset(100, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = genB.Reset(100, false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids := make(map[int64]bool)
+	next := func(g *IdGenerator) int64 {
+		id, err := g.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if id <= 100 || ids[id] {
+			t.Fatalf("unexpected id %d", id)
+		}
+		ids[id] = true
+		return id
+	}
+	for i := 0; i < 35; i++ {
+		next(genA)
+		next(genB)
+	}
+	// every segment of dc1 has an even index, of dc2 an odd index
+	if id := next(genA); (id-1)/10%2 != 0 {
+		t.Fatalf("id %d is not from dc1", id)
+	}
+
+	// dc1 is unreachable, a fails over to dc2
+	dc1.Close()
+	for i := 0; i < 30; i++ {
+		id := next(genA)
+		if i >= 10 && (id-1)/10%2 != 1 {
+			t.Fatalf("id %d is not from dc2", id)
+		}
+		next(genB)
+	}
+}
+
+func TestModuloStoreConfig(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	if _, err := NewModuloStore([]Master{
+		{Name: "dc1", Store: store, Offset: 0, Stride: 1},
+		{Name: "dc2", Store: store, Offset: 1, Stride: 1},
+	}, 10); err == nil {
+		t.Fatal("stride less than the count of masters should fail")
+	}
+	if _, err := NewModuloStore([]Master{
+		{Name: "dc1", Store: store, Offset: 1, Stride: 2},
+		{Name: "dc2", Store: store, Offset: 1, Stride: 2},
+	}, 10); err == nil {
+		t.Fatal("duplicate offset should fail")
+	}
+
+	m, err := NewModuloStore([]Master{{Name: "dc1", Store: store, Offset: 0, Stride: 2}}, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = m.Reset("abc", 1, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = m.Fetch("abc", 20); err == nil {
+		t.Fatal("fetch with another batch should fail")
+	}
+}
+
+func TestModuloStoreFetchContext(t *testing.T) {
+	dc1 := &flakyStore{block: true}
+	dc2 := &flakyStore{}
+	s, err := NewModuloStore([]Master{
+		{Name: "dc1", Store: dc1, Offset: 0, Stride: 2},
+		{Name: "dc2", Store: dc2, Offset: 1, Stride: 2},
+	}, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.FetchContext(ctx, "order", 10); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if dc1.fetches != 0 || dc2.fetches != 0 {
+		t.Fatalf("unexpected fetches %d %d", dc1.fetches, dc2.fetches)
+	}
+
+	// the blocked master is aborted by ctx, and the next one is not tried
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.FetchContext(ctx, "order", 10); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if dc1.fetches != 1 || dc2.fetches != 0 {
+		t.Fatalf("unexpected fetches %d %d", dc1.fetches, dc2.fetches)
+	}
+}
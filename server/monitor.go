@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the lines buffered for a monitor, the monitor is disconnected when
+	// its buffer is full
+	MonitorBufferSize = 1024
+)
+
+// monitor is a connection which receives every request served.
+type monitor struct {
+	client   *Client
+	lines    chan []byte
+	overflow chan struct{} // closed when the buffer is full
+	once     sync.Once
+}
+
+// monitorHub feeds the requests to the monitors, the zero value is ready to use.
+type monitorHub struct {
+	lock     sync.RWMutex
+	monitors map[*monitor]struct{}
+	count    atomic.Int32
+}
+
+func (h *monitorHub) add(c *Client) *monitor {
+	m := &monitor{
+		client:   c,
+		lines:    make(chan []byte, MonitorBufferSize),
+		overflow: make(chan struct{}),
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.monitors == nil {
+		h.monitors = make(map[*monitor]struct{})
+	}
+	h.monitors[m] = struct{}{}
+	h.count.Add(1)
+	return m
+}
+
+func (h *monitorHub) remove(m *monitor) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.monitors[m]; ok {
+		delete(h.monitors, m)
+		h.count.Add(-1)
+	}
+}
+
+// feed sends the request to every monitor without blocking.
+func (h *monitorHub) feed(r *Request) {
+	if h.count.Load() == 0 {
+		return
+	}
+	line := monitorLine(time.Now(), r)
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for m := range h.monitors {
+		select {
+		case m.lines <- line:
+		default:
+			m.once.Do(func() { close(m.overflow) })
+		}
+	}
+}
+
+// monitorLine formats the request like redis:
+// +1339518083.107412 [0 127.0.0.1:60866] "GET" "abc"
+func monitorLine(t time.Time, r *Request) []byte {
+	line := make([]byte, 0, 64)
+	line = append(line, '+')
+	line = strconv.AppendInt(line, t.Unix(), 10)
+	line = append(line, '.')
+	us := strconv.Itoa(t.Nanosecond() / 1000)
+	for i := len(us); i < 6; i++ {
+		line = append(line, '0')
+	}
+	line = append(line, us...)
+	line = append(line, " ["...)
+	line = strconv.AppendInt(line, int64(r.Namespace()), 10)
+	line = append(line, ' ')
+	line = append(line, r.RemoteAddress...)
+	line = append(line, "] "...)
+	line = strconv.AppendQuote(line, r.Command)
+	for _, arg := range r.Arguments {
+		line = append(line, ' ')
+		if r.Command == "AUTH" {
+			line = append(line, "(redacted)"...)
+			continue
+		}
+		line = strconv.AppendQuote(line, string(arg))
+	}
+	return append(line, "\r\n"...)
+}
+
+// serveMonitor streams the requests to conn until the connection is closed
+// or the buffer of the monitor is full.
+func (s *Server) serveMonitor(conn net.Conn, client *Client, writeTimeout time.Duration) error {
+	m := s.monitors.add(client)
+	defer s.monitors.remove(m)
+	conn.SetReadDeadline(time.Time{})
+
+	// the monitor does not run any command, read until it is closed
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case line := <-m.lines:
+			conn.SetWriteDeadline(deadline(writeTimeout))
+			if _, err := conn.Write(line); err != nil {
+				return err
+			}
+		case <-m.overflow:
+			client.log.Warn("monitor buffer is full, disconnect the monitor",
+				"buffer", MonitorBufferSize,
+			)
+			ErrMonitorOverflow.WriteTo(conn)
+			return ErrMonitorOverflow
+		case <-closed:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorLine(t *testing.T) {
+	r := newTestRequest("SET", "abc", "1")
+	r.RemoteAddress = "127.0.0.1:5000"
+	r.Client = &Client{Namespace: 2}
+	got := string(monitorLine(time.Unix(1339518083, 7412000), r))
+	if want := "+1339518083.007412 [2 127.0.0.1:5000] \"SET\" \"abc\" \"1\"\r\n"; got != want {
+		t.Fatalf("expect %q, got %q", want, got)
+	}
+
+	got = string(monitorLine(time.Unix(1339518083, 0), newTestRequest("AUTH", "admin", "secret")))
+	if strings.Contains(got, "secret") {
+		t.Fatalf("password is not redacted: %q", got)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	s := newTestServer(t)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.onConn(serverConn) }()
+
+	if _, err := clientConn.Write([]byte("*1\r\n$7\r\nMONITOR\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	reader := bufio.NewReader(clientConn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if line != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	// wait for the monitor to be added
+	for s.monitors.count.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	r := newTestRequest("GET", "monitor_key")
+	r.RemoteAddress = "10.0.0.1:6000"
+	s.ServeRequest(r)
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasSuffix(line, " [0 10.0.0.1:6000] \"GET\" \"monitor_key\"\r\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	clientConn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := s.monitors.count.Load(); n != 0 {
+		t.Fatalf("expect no monitor, got %d", n)
+	}
+}
+
+func TestMonitorOverflow(t *testing.T) {
+	var h monitorHub
+	m := h.add(&Client{})
+	defer h.remove(m)
+	r := newTestRequest("GET", "key")
+	for i := 0; i < MonitorBufferSize; i++ {
+		h.feed(r)
+	}
+	select {
+	case <-m.overflow:
+		t.Fatal("unexpected overflow")
+	default:
+	}
+
+	// the server does not block on the full buffer
+	h.feed(r)
+	select {
+	case <-m.overflow:
+	default:
+		t.Fatal("expect overflow")
+	}
+}
+
+func TestMonitorAccess(t *testing.T) {
+	s := newTestACLServer(t)
+	m := s.monitors.add(&Client{})
+	defer s.monitors.remove(m)
+	c := &Client{}
+	do := func(command string, args ...string) {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		s.ServeRequest(r)
+	}
+
+	// the unauthenticated and the denied commands are not fed
+	do("GET", "order_id")
+	do("AUTH", "order", "pass")
+	do("SET", "order_id", "1")
+	do("GET", "order_id")
+
+	var lines []string
+	for len(m.lines) != 0 {
+		lines = append(lines, string(<-m.lines))
+	}
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "\"AUTH\" (redacted) (redacted)\r\n") {
+		t.Fatalf("unexpected line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "\"GET\" \"order_id\"\r\n") {
+		t.Fatalf("unexpected line %q", lines[1])
+	}
+}
@@ -0,0 +1,556 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultMySQLCharset        = "utf8"
+	DefaultMySQLConnectTimeout = 5000  // millisecond
+	DefaultMySQLReadTimeout    = 10000 // millisecond
+	DefaultMySQLWriteTimeout   = 10000 // millisecond
+	MySQLPingTimeout           = 10 * time.Second
+	// every key is a table, the namespace prefix is part of the table name
+	MySQLMaxTableNameLength = 64
+
+	// create key table
+	CreateTableSQLFormat = `
+	CREATE TABLE %s (
+    id bigint(20) unsigned NOT NULL auto_increment,
+    PRIMARY KEY  (id)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	// create key table if not exist
+	CreateTableNTSQLFormat = `
+	CREATE TABLE IF NOT EXISTS %s (
+    id bigint(20) unsigned NOT NULL auto_increment,
+    PRIMARY KEY  (id)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	DropTableSQLFormat   = `DROP TABLE IF EXISTS %s`
+	InsertIdSQLFormat    = "INSERT INTO %s(id) VALUES(?)"
+	SelectForUpdate      = "SELECT id FROM %s FOR UPDATE"
+	UpdateIdSQLFormat    = "UPDATE %s SET id = id + ?"
+	GetRowCountSQLFormat = "SELECT count(*) FROM %s"
+	GetKeySQL            = "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+
+	KeyRecordTableName         = "__idgo__"
+	CreateRecordTableSQLFormat = `
+	CREATE TABLE %s (
+    k VARCHAR(255) NOT NULL,
+    PRIMARY KEY (k)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	// create key table if not exist
+	CreateRecordTableNTSQLFormat = `
+	CREATE TABLE IF NOT EXISTS %s (
+    k VARCHAR(255) NOT NULL,
+    PRIMARY KEY (k)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	InsertKeySQLFormat  = "INSERT INTO %s (k) VALUES (?)"
+	SelectKeySQLFormat  = "SELECT k FROM %s WHERE k = ?"
+	SelectKeysSQLFormat = "SELECT k FROM %s"
+	DeleteKeySQLFormat  = "DELETE FROM %s WHERE k = ?"
+
+	// the step of the keys
+	StepTableName              = "__idgo_step__"
+	CreateStepTableNTSQLFormat = `
+	CREATE TABLE IF NOT EXISTS %s (
+    k VARCHAR(255) NOT NULL,
+    step bigint(20) NOT NULL,
+    PRIMARY KEY (k)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	SelectStepSQLFormat  = "SELECT step FROM %s WHERE k = ?"
+	ReplaceStepSQLFormat = "REPLACE INTO %s (k, step) VALUES (?, ?)"
+
+	// the generation of the keys, changed by SET FORCE and DEL
+	GenerationTableName              = "__idgo_generation__"
+	CreateGenerationTableNTSQLFormat = `
+	CREATE TABLE IF NOT EXISTS %s (
+    k VARCHAR(255) NOT NULL,
+    generation bigint(20) NOT NULL,
+    PRIMARY KEY (k)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	SelectGenerationSQLFormat = "SELECT generation FROM %s WHERE k = ?"
+	BumpGenerationSQLFormat   = "INSERT INTO %s (k, generation) VALUES (?, 1) ON DUPLICATE KEY UPDATE generation = generation + 1"
+
+	// the audit entries of SET and DEL
+	CreateAuditTableNTSQLFormat = `
+	CREATE TABLE IF NOT EXISTS %s (
+    id bigint(20) unsigned NOT NULL auto_increment,
+    ts bigint(20) NOT NULL,
+    user VARCHAR(255) NOT NULL,
+    client VARCHAR(255) NOT NULL,
+    command VARCHAR(16) NOT NULL,
+    ns int NOT NULL,
+    k VARCHAR(255) NOT NULL,
+    old_value bigint(20) NULL,
+    new_value bigint(20) NULL,
+    err VARCHAR(1024) NOT NULL,
+    PRIMARY KEY (id),
+    KEY idx_ns_k (ns, k)
+) ENGINE=Innodb DEFAULT CHARSET=utf8 `
+
+	InsertAuditSQLFormat    = "INSERT INTO %s (ts, user, client, command, ns, k, old_value, new_value, err) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	SelectAuditSQLFormat    = "SELECT id, ts, user, client, command, ns, k, old_value, new_value, err FROM %s WHERE ns = ? ORDER BY id DESC LIMIT ?"
+	SelectKeyAuditSQLFormat = "SELECT id, ts, user, client, command, ns, k, old_value, new_value, err FROM %s WHERE ns = ? AND k = ? ORDER BY id DESC LIMIT ?"
+)
+
+// MySQLStore stores every key in a table which only has one row to record
+// the id, and registers the keys in the __idgo__ table. The key is always
+// quoted as an identifier and the values are passed as parameters.
+type MySQLStore struct {
+	name string
+	db   *sql.DB
+}
+
+// NewMySQLStore opens the database and pings it, so an unreachable
+// database fails at startup.
+func NewMySQLStore(c *config.DBConfig) (*MySQLStore, error) {
+	mc, err := mysqlConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	name := c.Name
+	if len(name) == 0 {
+		name = mc.DBName
+	}
+	connector, err := mysql.NewConnector(mc)
+	if err != nil {
+		return nil, fmt.Errorf("mysql %s:%v", name, err)
+	}
+	db := sql.OpenDB(connector)
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	db.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetime) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(c.ConnMaxIdleTime) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), MySQLPingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		logger.Error("connect database error",
+			"db", name,
+			"addr", mc.Addr,
+			"err", err,
+		)
+		return nil, fmt.Errorf("mysql %s:can not connect to %s %s:%v", name, mc.Net, mc.Addr, err)
+	}
+	return &MySQLStore{name: name, db: db}, nil
+}
+
+// mysqlConfig returns the driver config of c, the fields of c are
+// ignored if c has a DSN.
+func mysqlConfig(c *config.DBConfig) (*mysql.Config, error) {
+	if len(c.DSN) != 0 {
+		mc, err := mysql.ParseDSN(c.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("mysql %s:invalid dsn:%v", c.Name, err)
+		}
+		return mc, nil
+	}
+
+	mc := mysql.NewConfig()
+	mc.User = c.User
+	mc.Passwd = c.Password
+	mc.DBName = c.DBName
+	if len(c.Socket) != 0 {
+		mc.Net = "unix"
+		mc.Addr = c.Socket
+	} else {
+		mc.Net = "tcp"
+		mc.Addr = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	}
+	mc.Params = map[string]string{"charset": DefaultMySQLCharset}
+	if len(c.Charset) != 0 {
+		mc.Params["charset"] = c.Charset
+	}
+	for k, v := range c.Params {
+		mc.Params[k] = v
+	}
+	mc.Timeout = milliseconds(c.ConnectTimeout, DefaultMySQLConnectTimeout)
+	mc.ReadTimeout = milliseconds(c.ReadTimeout, DefaultMySQLReadTimeout)
+	mc.WriteTimeout = milliseconds(c.WriteTimeout, DefaultMySQLWriteTimeout)
+
+	switch c.TLS {
+	case "", "false":
+		if len(c.TLSCAFile) != 0 || len(c.TLSCertFile) != 0 {
+			return nil, fmt.Errorf("mysql %s:tls files need tls", c.Name)
+		}
+	case "true", "skip-verify", "preferred":
+		mc.TLSConfig = c.TLS
+		if len(c.TLSCAFile) != 0 || len(c.TLSCertFile) != 0 {
+			tc, err := mysqlTLSConfig(c)
+			if err != nil {
+				return nil, err
+			}
+			key := "idgo_" + c.Name + "_" + mc.Addr
+			if err := mysql.RegisterTLSConfig(key, tc); err != nil {
+				return nil, err
+			}
+			mc.TLSConfig = key
+		}
+	default:
+		return nil, fmt.Errorf("mysql %s:%s:invalid tls", c.Name, c.TLS)
+	}
+	return mc, nil
+}
+
+// mysqlTLSConfig loads the CA and the client certificate of c
+func mysqlTLSConfig(c *config.DBConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.Host,
+		InsecureSkipVerify: c.TLS == "skip-verify",
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(c.TLSCAFile) != 0 {
+		data, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("mysql %s:%s:have no certificate", c.Name, c.TLSCAFile)
+		}
+	}
+	if len(c.TLSCertFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func milliseconds(n int, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+func (s *MySQLStore) Init() error {
+	createTableNtSQL := fmt.Sprintf(CreateRecordTableNTSQLFormat, quoteIdentifier(KeyRecordTableName))
+	_, err := s.db.Exec(createTableNtSQL)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf(CreateStepTableNTSQLFormat, quoteIdentifier(StepTableName)))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf(CreateGenerationTableNTSQLFormat, quoteIdentifier(GenerationTableName)))
+	return err
+}
+
+func (s *MySQLStore) Keys() ([]string, error) {
+	keys := make([]string, 0)
+	selectKeysSQL := fmt.Sprintf(SelectKeysSQLFormat, quoteIdentifier(KeyRecordTableName))
+	rows, err := s.db.Query(selectKeysSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		idGenKey := ""
+		err := rows.Scan(&idGenKey)
+		if err != nil {
+			return nil, err
+		}
+		if idGenKey != "" {
+			keys = append(keys, idGenKey)
+		}
+	}
+	return keys, rows.Err()
+}
+
+func (s *MySQLStore) IsKeyExist(key string) (bool, error) {
+	var tableName string
+	var haveValue bool
+	if len(key) == 0 {
+		return false, nil
+	}
+	rows, err := s.db.Query(GetKeySQL, key)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&tableName)
+		if err != nil {
+			return false, err
+		}
+		haveValue = true
+	}
+	if haveValue == false {
+		return false, nil
+	}
+	return true, nil
+}
+
+// get id from key table
+func (s *MySQLStore) Current(key string) (int64, error) {
+	var id int64
+	selectForUpdate := fmt.Sprintf(SelectForUpdate, quoteIdentifier(key))
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(selectForUpdate)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	tx.Commit()
+
+	return id, nil
+}
+
+func (s *MySQLStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+func (s *MySQLStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	var id int64
+	var haveValue bool
+	selectForUpdate := fmt.Sprintf(SelectForUpdate, quoteIdentifier(key))
+	updateIdSql := fmt.Sprintf(UpdateIdSQLFormat, quoteIdentifier(key))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, selectForUpdate)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for rows.Next() {
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		haveValue = true
+	}
+	rows.Close()
+	// When the idgo table has no id key
+	if haveValue == false {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s:have no id key", key)
+	}
+	_, err = tx.ExecContext(ctx, updateIdSql, step)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// if force is true, create table directly
+// if force is false, create table use CreateTableNTSQLFormat
+func (s *MySQLStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	if len(key) > MySQLMaxTableNameLength {
+		return 0, fmt.Errorf("%s:key is longer than the %d bytes of a mysql table name", key, MySQLMaxTableNameLength)
+	}
+	var err error
+	createTableSQL := fmt.Sprintf(CreateTableSQLFormat, quoteIdentifier(key))
+	createTableNtSQL := fmt.Sprintf(CreateTableNTSQLFormat, quoteIdentifier(key))
+	dropTableSQL := fmt.Sprintf(DropTableSQLFormat, quoteIdentifier(key))
+
+	if force == true {
+		_, err = s.db.Exec(dropTableSQL)
+		if err != nil {
+			return 0, err
+		}
+		_, err = s.db.Exec(createTableSQL)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		var rowCount int64
+		_, err = s.db.Exec(createTableNtSQL)
+		if err != nil {
+			return 0, err
+		}
+		// check the idgo value if exist
+		getRowCountSQL := fmt.Sprintf(GetRowCountSQLFormat, quoteIdentifier(key))
+		err = s.db.QueryRow(getRowCountSQL).Scan(&rowCount)
+		if err != nil {
+			return 0, err
+		}
+
+		if rowCount == int64(1) {
+			id, err := s.Current(key)
+			if err != nil {
+				return 0, err
+			}
+			return id, s.setKey(key)
+		}
+	}
+
+	insertIdSQL := fmt.Sprintf(InsertIdSQLFormat, quoteIdentifier(key))
+	_, err = s.db.Exec(insertIdSQL, idOffset)
+	if err != nil {
+		s.db.Exec(dropTableSQL)
+		return 0, err
+	}
+	return idOffset, s.setKey(key)
+}
+
+func (s *MySQLStore) Delete(key string) error {
+	dropTableSQL := fmt.Sprintf(DropTableSQLFormat, quoteIdentifier(key))
+	_, err := s.db.Exec(dropTableSQL)
+	if err != nil {
+		return err
+	}
+	return s.delKey(key)
+}
+
+func (s *MySQLStore) Step(key string) (int64, error) {
+	var step int64
+	err := s.db.QueryRow(fmt.Sprintf(SelectStepSQLFormat, quoteIdentifier(StepTableName)), key).Scan(&step)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return step, err
+}
+
+func (s *MySQLStore) SetStep(key string, step int64) error {
+	var err error
+	if step == 0 {
+		_, err = s.db.Exec(fmt.Sprintf(DeleteKeySQLFormat, quoteIdentifier(StepTableName)), key)
+	} else {
+		_, err = s.db.Exec(fmt.Sprintf(ReplaceStepSQLFormat, quoteIdentifier(StepTableName)), key, step)
+	}
+	return err
+}
+
+func (s *MySQLStore) Generation(key string) (int64, error) {
+	var generation int64
+	err := s.db.QueryRow(fmt.Sprintf(SelectGenerationSQLFormat, quoteIdentifier(GenerationTableName)), key).Scan(&generation)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return generation, err
+}
+
+func (s *MySQLStore) BumpGeneration(key string) error {
+	_, err := s.db.Exec(fmt.Sprintf(BumpGenerationSQLFormat, quoteIdentifier(GenerationTableName)), key)
+	return err
+}
+
+func (s *MySQLStore) InitAudit() error {
+	_, err := s.db.Exec(fmt.Sprintf(CreateAuditTableNTSQLFormat, quoteIdentifier(AuditTableName)))
+	return err
+}
+
+func (s *MySQLStore) AppendAudit(e *AuditEntry) error {
+	r, err := s.db.Exec(fmt.Sprintf(InsertAuditSQLFormat, quoteIdentifier(AuditTableName)), auditArgs(e)...)
+	if err != nil {
+		return err
+	}
+	e.ID, err = r.LastInsertId()
+	return err
+}
+
+func (s *MySQLStore) AuditEntries(ns int, key string, count int) ([]*AuditEntry, error) {
+	return queryAuditEntries(s.db,
+		fmt.Sprintf(SelectAuditSQLFormat, quoteIdentifier(AuditTableName)),
+		fmt.Sprintf(SelectKeyAuditSQLFormat, quoteIdentifier(AuditTableName)),
+		ns, key, count,
+	)
+}
+
+func (s *MySQLStore) DBs() map[string]*sql.DB {
+	return map[string]*sql.DB{s.name: s.db}
+}
+
+func (s *MySQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *MySQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *MySQLStore) getKey(key string) (string, error) {
+	keyName := ""
+	selectKeySQL := fmt.Sprintf(SelectKeySQLFormat, quoteIdentifier(KeyRecordTableName))
+	rows, err := s.db.Query(selectKeySQL, key)
+	if err != nil {
+		return keyName, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&keyName)
+		if err != nil {
+			return keyName, err
+		}
+	}
+	if keyName == "" {
+		return keyName, fmt.Errorf("%s:not exists key", key)
+	}
+	return keyName, nil
+}
+
+func (s *MySQLStore) setKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%s:invalid key", key)
+	}
+	_, err := s.getKey(key)
+	if err == nil {
+		return nil
+	}
+	insertKeySQL := fmt.Sprintf(InsertKeySQLFormat, quoteIdentifier(KeyRecordTableName))
+	_, err = s.db.Exec(insertKeySQL, key)
+	return err
+}
+
+func (s *MySQLStore) delKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%s:invalid key", key)
+	}
+	_, err := s.getKey(key)
+	if err != nil {
+		return nil
+	}
+	deletetKeySQL := fmt.Sprintf(DeleteKeySQLFormat, quoteIdentifier(KeyRecordTableName))
+	_, err = s.db.Exec(deletetKeySQL, key)
+	return err
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestMySQLConfig(t *testing.T) {
+	mc, err := mysqlConfig(&config.DBConfig{
+		Host:     "127.0.0.1",
+		Port:     3306,
+		User:     "root",
+		Password: "pass",
+		DBName:   "idgo",
+		Params:   map[string]string{"sql_mode": "'STRICT_ALL_TABLES'"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mc.Net != "tcp" || mc.Addr != "127.0.0.1:3306" || mc.Params["charset"] != DefaultMySQLCharset ||
+		mc.Params["sql_mode"] == "" || mc.Timeout != DefaultMySQLConnectTimeout*time.Millisecond ||
+		mc.ReadTimeout != DefaultMySQLReadTimeout*time.Millisecond {
+		t.Fatalf("unexpected config %+v", mc)
+	}
+
+	mc, err = mysqlConfig(&config.DBConfig{Socket: "/tmp/mysql.sock", Charset: "utf8mb4", ConnectTimeout: 100, TLS: "true"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mc.Net != "unix" || mc.Addr != "/tmp/mysql.sock" || mc.Params["charset"] != "utf8mb4" ||
+		mc.Timeout != 100*time.Millisecond || mc.TLSConfig != "true" {
+		t.Fatalf("unexpected config %+v", mc)
+	}
+
+	// the dsn overrides the other fields
+	mc, err = mysqlConfig(&config.DBConfig{DSN: "u:p@tcp(db:3307)/ids?timeout=2s", Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mc.Addr != "db:3307" || mc.DBName != "ids" || mc.Timeout != 2*time.Second {
+		t.Fatalf("unexpected config %+v", mc)
+	}
+
+	for _, c := range []*config.DBConfig{
+		{DSN: "u:p@tcp(db:3307"},
+		{TLS: "yes"},
+		{TLSCAFile: "ca.pem"},
+		{TLS: "true", TLSCAFile: "/nonexistent/ca.pem"},
+	} {
+		if _, err := mysqlConfig(c); err == nil {
+			t.Fatalf("expect error of %+v", c)
+		}
+	}
+}
+
+func TestMySQLStoreUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	start := time.Now()
+	_, err = NewMySQLStore(&config.DBConfig{
+		Name:     "db0",
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		Password: "secret",
+	})
+	if err == nil {
+		t.Fatal("expect error of unreachable database")
+	}
+	if !strings.HasPrefix(err.Error(), "mysql db0:can not connect to tcp "+addr.String()) || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("ping is not failed fast: %v", d)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultNamespaces = 16
+	// the keys of namespace n (n > 0) are stored as __n__key,
+	// the keys of namespace 0 are stored as they are
+	namespaceKeyFormat = "__%d__%s"
+)
+
+// namespaceKey returns the key stored for key in namespace ns
+func namespaceKey(ns int, key string) string {
+	if ns == 0 {
+		return key
+	}
+	return fmt.Sprintf(namespaceKeyFormat, ns, key)
+}
+
+// splitNamespace returns the namespace and the key of a stored key,
+// ok is false if it is not a key of any namespace.
+func splitNamespace(storeKey string) (int, string, bool) {
+	if !strings.HasPrefix(storeKey, ReservedKeyPrefix) {
+		return 0, storeKey, true
+	}
+	rest := storeKey[len(ReservedKeyPrefix):]
+	i := strings.Index(rest, ReservedKeyPrefix)
+	if i <= 0 {
+		return 0, "", false
+	}
+	ns, err := strconv.Atoi(rest[:i])
+	if err != nil || ns <= 0 || strconv.Itoa(ns) != rest[:i] {
+		return 0, "", false
+	}
+	return ns, rest[i+len(ReservedKeyPrefix):], true
+}
@@ -2,24 +2,45 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"strconv"
 	"strings"
 )
 
 type Request struct {
+	ID            uint64 // set when the request is served
 	Command       string
 	Arguments     [][]byte
 	RemoteAddress string
 	Connection    io.ReadCloser
+	Client        *Client
+
+	ctx context.Context
+}
+
+// Context returns the context of the request, it carries the span of
+// the request when it is served.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
 func (r *Request) HasArgument(index int) bool {
 	return index >= 0 && index < len(r.Arguments)
 }
 
+// Namespace returns the namespace of the client
+func (r *Request) Namespace() int {
+	if r.Client == nil {
+		return 0
+	}
+	return r.Client.Namespace
+}
+
 func (r *Request) ExpectArgument(index int) *ErrorReply {
 	if !r.HasArgument(index) {
 		return ErrNotEnoughArgs
@@ -38,71 +59,118 @@ func (r *Request) GetInt(index int) (int64, *ErrorReply) {
 	}
 }
 
+// RequestLimits caps the argument count and the bulk length of a request,
+// the request over the limits gets an error reply and the connection is closed.
+type RequestLimits struct {
+	MaxArgs       int
+	MaxBulkLength int
+}
+
+var DefaultRequestLimits = RequestLimits{
+	MaxArgs:       DefaultMaxArgs,
+	MaxBulkLength: DefaultMaxBulkLength,
+}
+
 func NewRequest(conn io.ReadCloser) (*Request, error) {
-	reader := bufio.NewReader(conn)
+	request, err := ReadRequest(bufio.NewReader(conn), DefaultRequestLimits)
+	if err != nil {
+		return nil, err
+	}
+	request.Connection = conn
+	return request, nil
+}
 
+// ReadRequest reads a request from reader, reader should be kept for the
+// following requests of the connection.
+func ReadRequest(reader *bufio.Reader, limits RequestLimits) (*Request, error) {
 	// *<number of arguments>CRLF
-	line, err := reader.ReadString('\n')
+	line, err := readLine(reader)
 	if err != nil {
 		return nil, err
 	}
 
-	var argCount int
 	if line[0] == '*' {
-		if _, err := fmt.Sscanf(line, "*%d\r\n", &argCount); err != nil {
+		argCount, err := strconv.Atoi(line[1:])
+		if err != nil {
 			return nil, Malformed("*<#Arguments>", line)
 		}
+		if argCount < 1 || argCount > limits.MaxArgs {
+			return nil, ErrInvalidMultibulkLength
+		}
 
 		// $<number of bytes of argument 1>CRLF
 		// <argument data>CRLF
-		command, err := readArgument(reader)
+		command, err := readArgument(reader, limits.MaxBulkLength)
 		if err != nil {
 			return nil, err
 		}
 
 		arguments := make([][]byte, argCount-1)
 		for i := 0; i < argCount-1; i++ {
-			if arguments[i], err = readArgument(reader); err != nil {
+			if arguments[i], err = readArgument(reader, limits.MaxBulkLength); err != nil {
 				return nil, err
 			}
 		}
 
 		return &Request{
-			Command:    strings.ToUpper(string(command)),
-			Arguments:  arguments,
-			Connection: conn,
+			Command:   strings.ToUpper(string(command)),
+			Arguments: arguments,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("new request error")
 }
 
-func readArgument(reader *bufio.Reader) ([]byte, error) {
-	line, err := reader.ReadString('\n')
+// readLine reads a line without CRLF, the line must fit in the buffer of reader
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", ErrLineTooLong
+	}
 	if err != nil {
-		return nil, Malformed("$<ArgumentLength>", line)
+		return "", err
 	}
-
-	var argLength int
-	if _, err := fmt.Sscanf(line, "$%d\r\n", &argLength); err != nil {
-		return nil, Malformed("$<ArgumentLength>", line)
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", MalformedMissingCRLF()
 	}
+	return string(line[:len(line)-2]), nil
+}
 
-	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(argLength)))
+// readArgument reads a bulk argument, the errors of reader are returned as
+// they are so the timeouts can be told, io.EOF is io.ErrUnexpectedEOF in the
+// middle of a request.
+func readArgument(reader *bufio.Reader, maxLength int) ([]byte, error) {
+	line, err := readLine(reader)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return nil, err
 	}
-	if len(data) != argLength {
-		return nil, MalformedLength(argLength, len(data))
+
+	if line[0] != '$' {
+		return nil, Malformed("$<ArgumentLength>", line)
+	}
+	argLength, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, Malformed("$<ArgumentLength>", line)
+	}
+	if argLength < 0 || argLength > maxLength {
+		return nil, ErrInvalidBulkLength
 	}
-	if b, err := reader.ReadByte(); err != nil || b != '\r' {
-		return nil, MalformedMissingCRLF()
+
+	data := make([]byte, argLength+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
-	if b, err := reader.ReadByte(); err != nil || b != '\n' {
+	if data[argLength] != '\r' || data[argLength+1] != '\n' {
 		return nil, MalformedMissingCRLF()
 	}
 
-	return data, nil
+	return data[:argLength], nil
 }
 
 func Malformed(expected string, got string) error {
@@ -129,7 +197,33 @@ var (
 	ErrExpectMorePair       = &ErrorReply{"Expected at least one key val pair"}
 	ErrExpectEvenPair       = &ErrorReply{"Got uneven number of key val pairs"}
 
-	ErrNoKey = &ErrorReply{"no key for set"}
+	ErrNoKey      = &ErrorReply{"no key for set"}
+	ErrInvalidKey = &ErrorReply{"invalid key"}
+
+	ErrNamespaceOutOfRange = &ErrorReply{"DB index is out of range"}
+
+	ErrNoAuth         = &ErrorReply{"authentication required"}
+	ErrWrongPass      = &ErrorReply{"invalid username-password pair"}
+	ErrAuthNotEnabled = &ErrorReply{"AUTH called without any user configured"}
+	ErrNoPermission   = &ErrorReply{"no permission to run the command"}
+
+	ErrAuditNotEnabled = &ErrorReply{"audit is not enabled"}
+	ErrInvalidCount    = &ErrorReply{"count is out of range"}
+	ErrMonitorOverflow = &ErrorReply{"monitor buffer is full"}
+
+	ErrSyntax      = &ErrorReply{"syntax error"}
+	ErrInvalidStep = &ErrorReply{"step is out of range"}
+	ErrFixedStep   = &ErrorReply{"the step of the key can not be set"}
+
+	ErrMaxClients             = &ErrorReply{"max number of clients reached"}
+	ErrInvalidMultibulkLength = &ErrorReply{"Protocol error: invalid multibulk length"}
+	ErrInvalidBulkLength      = &ErrorReply{"Protocol error: invalid bulk length"}
+	ErrLineTooLong            = &ErrorReply{"Protocol error: too big line"}
+
+	ErrClientRateLimited    = &ErrorReply{"rate limit exceeded for the client"}
+	ErrKeyRateLimited       = &ErrorReply{"rate limit exceeded for the key"}
+	ErrDailyQuotaExceeded   = &ErrorReply{"daily quota exceeded for the key"}
+	ErrMonthlyQuotaExceeded = &ErrorReply{"monthly quota exceeded for the key"}
 )
 
 type ErrorReply struct {
@@ -137,7 +231,7 @@ type ErrorReply struct {
 }
 
 func (er *ErrorReply) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte("-ERROR " + er.message + "\r\n"))
+	n, err := w.Write([]byte("-ERR " + er.message + "\r\n"))
 	return int64(n), err
 }
 
@@ -194,6 +288,27 @@ func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
 	}
 }
 
+// ArrayReply is an array of replies, such as an array of arrays
+type ArrayReply struct {
+	values []Reply
+}
+
+func (r *ArrayReply) WriteTo(w io.Writer) (int64, error) {
+	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(r.values)) + "\r\n"))
+	total := int64(wrote)
+	if err != nil {
+		return total, err
+	}
+	for _, value := range r.values {
+		n, err := value.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func writeNullBytes(w io.Writer) (int64, error) {
 	n, err := w.Write([]byte("$-1\r\n"))
 	return int64(n), err
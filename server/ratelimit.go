@@ -0,0 +1,342 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DayLayout   = "2006-01-02"
+	MonthLayout = "2006-01"
+
+	// the max buckets of the clients, the least recently used bucket is
+	// evicted over it
+	MaxClientBuckets = 10000
+)
+
+// limitRule is a token bucket of every client identity or key matching glob
+type limitRule struct {
+	glob  string
+	limit rate.Limit
+	burst int
+}
+
+// clientBucket is the bucket of a client identity, it is full after it is
+// idle for refill, so it can be evicted then without changing the limit.
+type clientBucket struct {
+	identity string
+	limiter  *rate.Limiter
+	refill   time.Duration
+	usedAt   time.Time
+}
+
+type quotaRule struct {
+	glob    string
+	daily   int64
+	monthly int64
+}
+
+// quotaUsage is the ids issued of a key in the current day and month
+type quotaUsage struct {
+	rule      *quotaRule
+	day       string
+	dayUsed   int64
+	month     string
+	monthUsed int64
+}
+
+// Limiter enforces the rate limits of the clients and the keys, and the
+// daily and monthly quotas of the ids issued of the keys. The buckets and
+// the usages are kept in memory of the server.
+type Limiter struct {
+	clientRules []*limitRule
+	keyRules    []*limitRule
+	quotaRules  []*quotaRule
+
+	lock       sync.Mutex
+	clients    map[string]*list.Element // client identity -> element of clientList
+	clientList *list.List               // the client buckets, the most recently used first
+	maxClients int
+	keys       map[string]*rate.Limiter // key -> bucket
+	usages     map[string]*quotaUsage   // key -> usage
+	now        func() time.Time
+
+	// the requests rejected
+	clientLimited atomic.Int64
+	keyLimited    atomic.Int64
+	quotaExceeded atomic.Int64
+}
+
+// NewLimiter creates the limiter, it returns nil if there is no rate limit
+// and quota.
+func NewLimiter(limits []*config.RateLimitConfig, quotas []*config.QuotaConfig) (*Limiter, error) {
+	if len(limits) == 0 && len(quotas) == 0 {
+		return nil, nil
+	}
+	l := &Limiter{
+		clients:    make(map[string]*list.Element),
+		clientList: list.New(),
+		maxClients: MaxClientBuckets,
+		keys:       make(map[string]*rate.Limiter),
+		usages:     make(map[string]*quotaUsage),
+		now:        time.Now,
+	}
+	for _, c := range limits {
+		if (len(c.Client) == 0) == (len(c.Key) == 0) {
+			return nil, fmt.Errorf("rate_limits:need one of client and key")
+		}
+		if c.Rate <= 0 {
+			return nil, fmt.Errorf("rate_limits:%v:invalid rate", c.Rate)
+		}
+		r := &limitRule{
+			glob:  c.Client + c.Key,
+			limit: rate.Limit(c.Rate),
+			burst: c.Burst,
+		}
+		if _, err := path.Match(r.glob, ""); err != nil {
+			return nil, fmt.Errorf("rate_limits:%s:invalid glob", r.glob)
+		}
+		if r.burst <= 0 {
+			r.burst = int(math.Ceil(c.Rate))
+		}
+		if len(c.Client) != 0 {
+			l.clientRules = append(l.clientRules, r)
+		} else {
+			l.keyRules = append(l.keyRules, r)
+		}
+	}
+	for _, c := range quotas {
+		if len(c.Key) == 0 {
+			return nil, fmt.Errorf("quotas:have no key")
+		}
+		if _, err := path.Match(c.Key, ""); err != nil {
+			return nil, fmt.Errorf("quotas:%s:invalid glob", c.Key)
+		}
+		if c.Daily < 0 || c.Monthly < 0 || c.Daily == 0 && c.Monthly == 0 {
+			return nil, fmt.Errorf("quotas:%s:invalid daily or monthly", c.Key)
+		}
+		l.quotaRules = append(l.quotaRules, &quotaRule{
+			glob:    c.Key,
+			daily:   c.Daily,
+			monthly: c.Monthly,
+		})
+	}
+	return l, nil
+}
+
+// matchRule returns the first rule whose glob matches name
+func matchRule(rules []*limitRule, name string) *limitRule {
+	for _, r := range rules {
+		if ok, _ := path.Match(r.glob, name); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// clientIdentity is the user name of an authenticated client, or the ip
+func clientIdentity(r *Request) string {
+	if r.Client != nil && r.Client.User != nil {
+		return r.Client.User.Name
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddress); err == nil {
+		return host
+	}
+	return r.RemoteAddress
+}
+
+// AllowClient takes a token from the bucket of the client of the request.
+func (l *Limiter) AllowClient(r *Request) *ErrorReply {
+	if len(l.clientRules) == 0 {
+		return nil
+	}
+	identity := clientIdentity(r)
+	rule := matchRule(l.clientRules, identity)
+	if rule == nil {
+		return nil
+	}
+	now := l.now()
+	l.lock.Lock()
+	b := l.clientBucket(identity, rule, now)
+	l.lock.Unlock()
+	if !b.AllowN(now, 1) {
+		rateLimited.WithLabelValues("client").Inc()
+		l.clientLimited.Add(1)
+		return ErrClientRateLimited
+	}
+	return nil
+}
+
+// clientBucket returns the bucket of the client identity. The buckets idle
+// long enough to be full are evicted before a bucket is created, and the
+// least recently used ones over maxClients. It must be called with the lock.
+func (l *Limiter) clientBucket(identity string, rule *limitRule, now time.Time) *rate.Limiter {
+	if e, ok := l.clients[identity]; ok {
+		b := e.Value.(*clientBucket)
+		b.usedAt = now
+		l.clientList.MoveToFront(e)
+		return b.limiter
+	}
+	for e := l.clientList.Back(); e != nil; e = l.clientList.Back() {
+		b := e.Value.(*clientBucket)
+		if now.Sub(b.usedAt) < b.refill && l.clientList.Len() < l.maxClients {
+			break
+		}
+		l.clientList.Remove(e)
+		delete(l.clients, b.identity)
+	}
+	b := &clientBucket{
+		identity: identity,
+		limiter:  rate.NewLimiter(rule.limit, rule.burst),
+		refill:   time.Duration(float64(rule.burst) / float64(rule.limit) * float64(time.Second)),
+		usedAt:   now,
+	}
+	l.clients[identity] = l.clientList.PushFront(b)
+	return b.limiter
+}
+
+// AllowKey checks the quota of the key, takes a token from the bucket of
+// the key and counts an id in the quota, the id should be released if it
+// is not issued. The token is not taken if the quota is exceeded. key is
+// the key name and nsKey is the key in its namespace.
+func (l *Limiter) AllowKey(key string, nsKey string) *ErrorReply {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	u := l.usage(key, nsKey)
+	if u != nil && u.rule.daily != 0 && u.dayUsed >= u.rule.daily {
+		rateLimited.WithLabelValues("daily_quota").Inc()
+		l.quotaExceeded.Add(1)
+		return ErrDailyQuotaExceeded
+	}
+	if u != nil && u.rule.monthly != 0 && u.monthUsed >= u.rule.monthly {
+		rateLimited.WithLabelValues("monthly_quota").Inc()
+		l.quotaExceeded.Add(1)
+		return ErrMonthlyQuotaExceeded
+	}
+
+	if rule := matchRule(l.keyRules, key); rule != nil {
+		b, ok := l.keys[nsKey]
+		if !ok {
+			b = rate.NewLimiter(rule.limit, rule.burst)
+			l.keys[nsKey] = b
+		}
+		if !b.Allow() {
+			rateLimited.WithLabelValues("key").Inc()
+			l.keyLimited.Add(1)
+			return ErrKeyRateLimited
+		}
+	}
+	if u != nil {
+		u.dayUsed++
+		u.monthUsed++
+	}
+	return nil
+}
+
+// Release returns the id counted by AllowKey to the quota of the key.
+func (l *Limiter) Release(nsKey string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if u, ok := l.usages[nsKey]; ok {
+		if u.dayUsed > 0 {
+			u.dayUsed--
+		}
+		if u.monthUsed > 0 {
+			u.monthUsed--
+		}
+	}
+}
+
+// usage returns the usage of the key in the current day and month, nil if
+// the key has no quota. It must be called with the lock.
+func (l *Limiter) usage(key string, nsKey string) *quotaUsage {
+	u, ok := l.usages[nsKey]
+	if !ok {
+		var rule *quotaRule
+		for _, r := range l.quotaRules {
+			if ok, _ := path.Match(r.glob, key); ok {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			return nil
+		}
+		u = &quotaUsage{rule: rule}
+		l.usages[nsKey] = u
+	}
+	now := l.now()
+	if day := now.Format(DayLayout); day != u.day {
+		u.day = day
+		u.dayUsed = 0
+	}
+	if month := now.Format(MonthLayout); month != u.month {
+		u.month = month
+		u.monthUsed = 0
+	}
+	return u
+}
+
+// Info returns the lines of the rules and the quota usages of the keys for INFO.
+func (l *Limiter) Info() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lines := []string{
+		fmt.Sprintf("client_rate_limits:%d", len(l.clientRules)),
+		fmt.Sprintf("key_rate_limits:%d", len(l.keyRules)),
+		fmt.Sprintf("quotas:%d", len(l.quotaRules)),
+		fmt.Sprintf("client_rate_limited:%d", l.clientLimited.Load()),
+		fmt.Sprintf("key_rate_limited:%d", l.keyLimited.Load()),
+		fmt.Sprintf("quota_exceeded:%d", l.quotaExceeded.Load()),
+	}
+	quotas := make([]string, 0, len(l.usages))
+	for nsKey := range l.usages {
+		u := l.usage("", nsKey)
+		quotas = append(quotas, fmt.Sprintf("quota_%s:daily_used=%d,daily_limit=%d,monthly_used=%d,monthly_limit=%d",
+			nsKey, u.dayUsed, u.rule.daily, u.monthUsed, u.rule.monthly))
+	}
+	sort.Strings(quotas)
+	return append(lines, quotas...)
+}
+
+// inherit takes the quota usages and the rejected counts of the old limiter
+// replaced by l, the buckets of the rate limits start full.
+func (l *Limiter) inherit(old *Limiter) {
+	if l == nil || old == nil {
+		return
+	}
+	old.lock.Lock()
+	defer old.lock.Unlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for nsKey, u := range old.usages {
+		_, key, ok := splitNamespace(nsKey)
+		if !ok {
+			continue
+		}
+		nu := l.usage(key, nsKey)
+		if nu == nil {
+			continue
+		}
+		if nu.day == u.day {
+			nu.dayUsed = u.dayUsed
+		}
+		if nu.month == u.month {
+			nu.monthUsed = u.monthUsed
+		}
+	}
+	l.clientLimited.Store(old.clientLimited.Load())
+	l.keyLimited.Store(old.keyLimited.Load())
+	l.quotaExceeded.Store(old.quotaExceeded.Load())
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestNewLimiter(t *testing.T) {
+	if l, err := NewLimiter(nil, nil); l != nil || err != nil {
+		t.Fatal("expect no limiter")
+	}
+	for _, c := range []*config.RateLimitConfig{
+		{Rate: 10},
+		{Client: "a", Key: "b", Rate: 10},
+		{Key: "b", Rate: 0},
+		{Key: "[", Rate: 10},
+	} {
+		if _, err := NewLimiter([]*config.RateLimitConfig{c}, nil); err == nil {
+			t.Fatalf("expect error of %+v", c)
+		}
+	}
+	if _, err := NewLimiter(nil, []*config.QuotaConfig{{Key: "a"}}); err == nil {
+		t.Fatal("expect error of quota without limit")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	limiter, err := NewLimiter([]*config.RateLimitConfig{
+		{Client: "10.0.0.*", Rate: 0.001, Burst: 3},
+		{Key: "limit_*", Rate: 0.001, Burst: 2},
+	}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.limiter = limiter
+	do := func(addr string, command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.RemoteAddress = addr
+		return replyString(t, s.ServeRequest(r))
+	}
+
+	do("127.0.0.1:1", "SET", "limit_key", "1")
+	do("127.0.0.1:1", "SET", "other_key", "1")
+	for i := 0; i < 2; i++ {
+		if got := do("127.0.0.1:1", "GET", "limit_key"); got[0] != '$' {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	if got := do("127.0.0.1:1", "GET", "limit_key"); got != "-ERR rate limit exceeded for the key\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// the other keys are not limited
+	for i := 0; i < 5; i++ {
+		if got := do("127.0.0.1:1", "GET", "other_key"); got[0] != '$' {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+
+	// every client matching the glob has its own bucket
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.2:1"} {
+		for i := 0; i < 3; i++ {
+			if got := do(addr, "EXISTS", "other_key"); got != ":1\r\n" {
+				t.Fatalf("unexpected reply %q", got)
+			}
+		}
+		if got := do(addr, "EXISTS", "other_key"); got != "-ERR rate limit exceeded for the client\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+
+	info := replyString(t, s.ServeRequest(newTestRequest("INFO", "limits")))
+	for _, line := range []string{"# Limits\r\n", "client_rate_limited:2\r\n", "key_rate_limited:1\r\n"} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("expect %q in %q", line, info)
+		}
+	}
+}
+
+func TestClientBucketEviction(t *testing.T) {
+	limiter, err := NewLimiter([]*config.RateLimitConfig{{Client: "*", Rate: 1, Burst: 2}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	limiter.maxClients = 3
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	allow := func(addr string) *ErrorReply {
+		r := newTestRequest("EXISTS", "a")
+		r.RemoteAddress = addr
+		return limiter.AllowClient(r)
+	}
+
+	// the buckets over maxClients are evicted, the least recently used first
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1", "10.0.0.1:1", "10.0.0.4:1"} {
+		if err := allow(addr); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if _, ok := limiter.clients["10.0.0.2"]; ok || len(limiter.clients) != 3 {
+		t.Fatalf("unexpected buckets %v", limiter.clients)
+	}
+	// the bucket used recently is kept with its tokens
+	if err := allow("10.0.0.1:1"); err != ErrClientRateLimited {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the buckets idle until they are full are evicted
+	now = now.Add(2 * time.Second)
+	if err := allow("10.0.0.5:1"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(limiter.clients) != 1 || limiter.clientList.Len() != 1 {
+		t.Fatalf("unexpected buckets %v", limiter.clients)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newTestServer(t)
+	limiter, err := NewLimiter(nil, []*config.QuotaConfig{
+		{Key: "quota_*", Daily: 3, Monthly: 5},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Date(2026, 1, 30, 12, 0, 0, 0, time.Local)
+	limiter.now = func() time.Time { return now }
+	s.limiter = limiter
+
+	get := func() string {
+		return replyString(t, s.ServeRequest(newTestRequest("GET", "quota_key")))
+	}
+	s.ServeRequest(newTestRequest("SET", "quota_key", "1"))
+	for i := 0; i < 3; i++ {
+		if got := get(); got[0] != '$' {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	if got := get(); got != "-ERR daily quota exceeded for the key\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the daily quota is reset the next day, the monthly quota is not
+	now = now.AddDate(0, 0, 1)
+	for i := 0; i < 2; i++ {
+		if got := get(); got[0] != '$' {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	if got := get(); got != "-ERR monthly quota exceeded for the key\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	info := replyString(t, s.ServeRequest(newTestRequest("INFO")))
+	for _, line := range []string{
+		"quota_quota_key:daily_used=2,daily_limit=3,monthly_used=5,monthly_limit=5\r\n",
+		"quota_exceeded:2\r\n",
+		"# Keyspace\r\ndb0:keys=1\r\n",
+	} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("expect %q in %q", line, info)
+		}
+	}
+
+	// a new month
+	now = time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)
+	if got := get(); got[0] != '$' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestQuotaBeforeKeyToken(t *testing.T) {
+	limiter, err := NewLimiter([]*config.RateLimitConfig{{Key: "order", Rate: 0.001, Burst: 2}},
+		[]*config.QuotaConfig{{Key: "order", Daily: 1}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Date(2026, 1, 30, 12, 0, 0, 0, time.Local)
+	limiter.now = func() time.Time { return now }
+
+	if err := limiter.AllowKey("order", "order"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := limiter.AllowKey("order", "order"); err != ErrDailyQuotaExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the request over the quota took no token
+	now = now.AddDate(0, 0, 1)
+	if err := limiter.AllowKey("order", "order"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
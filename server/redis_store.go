@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultRedisPrefix  = "idgo:"
+	DefaultRedisTimeout = 3000 // millisecond
+
+	redisIdPrefix    = "id:"
+	redisKeysSetName = "keys"
+	redisStepsName   = "steps"
+	redisGenerations = "generations"
+	redisAuditPrefix = "audit:"
+	redisAuditIdName = "audit_id"
+)
+
+// INCRBY creates a missing key from 0, so check the key exists first
+var redisFetchScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+return redis.call("INCRBY", KEYS[1], ARGV[1])
+`)
+
+// RedisStore stores the high-water mark of every key in an upstream redis,
+// a segment is allocated by INCRBY and the keys are registered in a set.
+type RedisStore struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+func NewRedisStore(c *config.RedisConfig) (*RedisStore, error) {
+	if len(c.Addr) == 0 {
+		return nil, fmt.Errorf("redis:have no addr")
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRedisTimeout
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:         c.Addr,
+		Username:     c.User,
+		Password:     c.Password,
+		DB:           c.DB,
+		DialTimeout:  time.Duration(timeout) * time.Millisecond,
+		ReadTimeout:  time.Duration(timeout) * time.Millisecond,
+		WriteTimeout: time.Duration(timeout) * time.Millisecond,
+	})
+	return NewRedisStoreWithClient(client, c.Prefix, timeout), nil
+}
+
+// NewRedisStoreWithClient creates a RedisStore on a client,
+// timeout is in millisecond.
+func NewRedisStoreWithClient(client *redis.Client, prefix string, timeout int) *RedisStore {
+	if len(prefix) == 0 {
+		prefix = DefaultRedisPrefix
+	}
+	if timeout <= 0 {
+		timeout = DefaultRedisTimeout
+	}
+	return &RedisStore{
+		client:  client,
+		prefix:  prefix,
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+}
+
+func (s *RedisStore) idKey(key string) string {
+	return s.prefix + redisIdPrefix + key
+}
+
+func (s *RedisStore) keysSet() string {
+	return s.prefix + redisKeysSetName
+}
+
+// stepsHash is the hash of the steps of the keys
+func (s *RedisStore) stepsHash() string {
+	return s.prefix + redisStepsName
+}
+
+// generationsHash is the hash of the generations of the keys
+func (s *RedisStore) generationsHash() string {
+	return s.prefix + redisGenerations
+}
+
+// auditList is the list of the audit entries of namespace ns, or of the
+// key in ns if key is not empty, the latest entry is at the head.
+func (s *RedisStore) auditList(ns int, key string) string {
+	name := s.prefix + redisAuditPrefix + strconv.Itoa(ns)
+	if len(key) != 0 {
+		name += ":" + key
+	}
+	return name
+}
+
+func (s *RedisStore) Init() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Keys() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.client.SMembers(ctx, s.keysSet()).Result()
+}
+
+func (s *RedisStore) IsKeyExist(key string) (bool, error) {
+	if len(key) == 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	n, err := s.client.Exists(ctx, s.idKey(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+func (s *RedisStore) Current(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	id, err := s.client.Get(ctx, s.idKey(key)).Int64()
+	if err == redis.Nil {
+		return 0, fmt.Errorf("%s:have no id key", key)
+	}
+	return id, err
+}
+
+func (s *RedisStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+func (s *RedisStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	id, err := redisFetchScript.Run(ctx, s.client, []string{s.idKey(key)}, step).Int64()
+	if err == redis.Nil {
+		return 0, fmt.Errorf("%s:have no id key", key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id - step, nil
+}
+
+func (s *RedisStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	value := strconv.FormatInt(idOffset, 10)
+	if force {
+		_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.idKey(key), value, 0)
+			pipe.SAdd(ctx, s.keysSet(), key)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return idOffset, nil
+	}
+
+	var get *redis.StringCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, s.idKey(key), value, 0)
+		get = pipe.Get(ctx, s.idKey(key))
+		pipe.SAdd(ctx, s.keysSet(), key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return get.Int64()
+}
+
+func (s *RedisStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.idKey(key))
+		pipe.SRem(ctx, s.keysSet(), key)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Step(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	step, err := s.client.HGet(ctx, s.stepsHash(), key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return step, err
+}
+
+func (s *RedisStore) SetStep(key string, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if step == 0 {
+		return s.client.HDel(ctx, s.stepsHash(), key).Err()
+	}
+	return s.client.HSet(ctx, s.stepsHash(), key, step).Err()
+}
+
+func (s *RedisStore) Generation(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	generation, err := s.client.HGet(ctx, s.generationsHash(), key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return generation, err
+}
+
+func (s *RedisStore) BumpGeneration(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.client.HIncrBy(ctx, s.generationsHash(), key, 1).Err()
+}
+
+func (s *RedisStore) InitAudit() error {
+	return nil
+}
+
+// AppendAudit pushes e to the list of its namespace and the list of its
+// key, both lists keep the latest MaxStoredAuditEntries entries.
+func (s *RedisStore) AppendAudit(e *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	id, err := s.client.Incr(ctx, s.prefix+redisAuditIdName).Result()
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, list := range []string{s.auditList(e.Namespace, ""), s.auditList(e.Namespace, e.Key)} {
+			pipe.LPush(ctx, list, data)
+			pipe.LTrim(ctx, list, 0, MaxStoredAuditEntries-1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) AuditEntries(ns int, key string, count int) ([]*AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	values, err := s.client.LRange(ctx, s.auditList(ns, key), 0, int64(count)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*AuditEntry, 0, len(values))
+	for _, v := range values {
+		e := new(AuditEntry)
+		if err := json.Unmarshal([]byte(v), e); err != nil {
+			return nil, fmt.Errorf("audit:invalid entry %q", v)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
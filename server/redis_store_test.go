@@ -0,0 +1,105 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStoreWithClient(client, "idgo_test:", 0)
+	t.Cleanup(func() { store.Close() })
+	return store, mr
+}
+
+func TestRedisIdgen(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	idGenerator, err := NewIdGenerator(store, "redis_victory", 100)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = idGenerator.Reset(1, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := int64(2); i <= 251; i++ {
+		id, err := idGenerator.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if id != i {
+			t.Fatalf("expect %d, got %d", i, id)
+		}
+	}
+	// three segments are fetched, the high-water mark is at the end of the last one
+	if v, _ := mr.Get("idgo_test:id:redis_victory"); v != "301" {
+		t.Fatalf("expect high-water mark 301, got %s", v)
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || keys[0] != "redis_victory" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisResetAndDelete(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	if _, err := store.Fetch("missing", 10); err == nil {
+		t.Fatal("fetch a missing key should fail")
+	}
+	if exist, _ := store.IsKeyExist("missing"); exist {
+		t.Fatal("fetch should not create the key")
+	}
+
+	id, err := store.Reset("abc", 100, false)
+	if err != nil || id != 100 {
+		t.Fatalf("reset: %d %v", id, err)
+	}
+	// the existing value is kept when force is false
+	id, err = store.Reset("abc", 5, false)
+	if err != nil || id != 100 {
+		t.Fatalf("reset: %d %v", id, err)
+	}
+	id, err = store.Reset("abc", 5, true)
+	if err != nil || id != 5 {
+		t.Fatalf("force reset: %d %v", id, err)
+	}
+
+	if err := store.Delete("abc"); err != nil {
+		t.Fatal(err.Error())
+	}
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisGeneration(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	if g, err := store.Generation("abc"); err != nil || g != 0 {
+		t.Fatalf("generation: %d %v", g, err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		if err := store.BumpGeneration("abc"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if g, err := store.Generation("abc"); err != nil || g != i {
+			t.Fatalf("expect generation %d, got %d %v", i, g, err)
+		}
+	}
+}
+
+func TestRedisAudit(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	testAuditStore(t, store)
+}
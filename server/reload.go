@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/flike/idgo/config"
+)
+
+// ReloadResult is the settings changed by a reload, Applied are applied
+// live and Restart need a restart to take effect.
+type ReloadResult struct {
+	Applied []string
+	Restart []string
+}
+
+// SetConfigLoader sets the loader of the config used by ReloadConfig and
+// CONFIG RELOAD.
+func (s *Server) SetConfigLoader(loader func() (*config.Config, error)) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.configLoader = loader
+}
+
+// ReloadConfig loads the config by the config loader and reloads it.
+func (s *Server) ReloadConfig() (*ReloadResult, error) {
+	s.reloadMu.Lock()
+	loader := s.configLoader
+	s.reloadMu.Unlock()
+	if loader == nil {
+		return nil, fmt.Errorf("config:have no config file to reload")
+	}
+	c, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	return s.Reload(c)
+}
+
+// Reload applies the settings of c which can be changed live: log_level,
+// batch, users, rate_limits, quotas and the certificates of tls. All of
+// them are validated before any is applied, the connections are kept.
+func (s *Server) Reload(c *config.Config) (*ReloadResult, error) {
+	if err := checkLogLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+	if err := checkBatch(c.Batch); err != nil {
+		return nil, err
+	}
+	acl, err := NewACL(c.Users)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := NewLimiter(c.RateLimits, c.Quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old := s.liveCfg
+	if old == nil {
+		old = &config.Config{}
+	}
+	result := &ReloadResult{Restart: restartSettings(s.cfg, c)}
+
+	// the listener without tls needs a restart to enable it
+	var certs *certLoader
+	if current := s.currentCerts(); current != nil && c.TLS != nil {
+		if reflect.DeepEqual(old.TLS, c.TLS) {
+			err = current.Reload()
+		} else {
+			certs, err = newCertLoader(c.TLS)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changed := func(name string, a, b interface{}) bool {
+		if reflect.DeepEqual(a, b) {
+			return false
+		}
+		result.Applied = append(result.Applied, name)
+		return true
+	}
+	if changed("log_level", ParseLogLevel(old.LogLevel), ParseLogLevel(c.LogLevel)) {
+		logLevel.Set(ParseLogLevel(c.LogLevel))
+	}
+	s.reloadLock.Lock()
+	if changed("users", old.Users, c.Users) {
+		s.acl = acl
+	}
+	rateLimits := changed("rate_limits", old.RateLimits, c.RateLimits)
+	if changed("quotas", old.Quotas, c.Quotas) || rateLimits {
+		limiter.inherit(s.limiter)
+		s.limiter = limiter
+	}
+	if certs != nil {
+		result.Applied = append(result.Applied, "tls")
+		s.certs = certs
+	}
+	s.reloadLock.Unlock()
+	if changed("batch", old.Batch, c.Batch) {
+		s.batch.Store(c.Batch)
+		s.updateBatch()
+	}
+	s.liveCfg = c
+
+	logger.Info("config reloaded",
+		"applied", strings.Join(result.Applied, ","),
+		"restart", strings.Join(result.Restart, ","),
+	)
+	return result, nil
+}
+
+// restartSettings returns the settings of c which differ from the
+// settings the server started with and can not be applied live.
+func restartSettings(started *config.Config, c *config.Config) []string {
+	if started == nil {
+		started = &config.Config{}
+	}
+	settings := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"addr", started.Addr, c.Addr},
+		{"log_path", started.LogPath, c.LogPath},
+		{"log_format", started.LogFormat, c.LogFormat},
+		{"metrics_addr", started.MetricsAddr, c.MetricsAddr},
+		{"health_addr", started.HealthAddr, c.HealthAddr},
+		{"warm_segments", started.WarmSegments, c.WarmSegments},
+		{"key_check_interval", started.KeyCheckInterval, c.KeyCheckInterval},
+		{"namespaces", started.Namespaces, c.Namespaces},
+		{"maxclients", started.MaxClients, c.MaxClients},
+		{"timeout", started.IdleTimeout, c.IdleTimeout},
+		{"read_timeout", started.ReadTimeout, c.ReadTimeout},
+		{"write_timeout", started.WriteTimeout, c.WriteTimeout},
+		{"tcp_keepalive", started.TCPKeepAlive, c.TCPKeepAlive},
+		{"max_args", started.MaxArgs, c.MaxArgs},
+		{"max_bulk_length", started.MaxBulkLength, c.MaxBulkLength},
+		{"storage", started.Storage, c.Storage},
+		{"storage_db", started.DatabaseConfig, c.DatabaseConfig},
+		{"storage_dbs", started.DatabaseConfigs, c.DatabaseConfigs},
+		{"placement", started.Placement, c.Placement},
+		{"multi_master", started.MultiMasters, c.MultiMasters},
+		{"tls", started.TLS == nil, c.TLS == nil},
+		{"tracing", started.Tracing, c.Tracing},
+		{"audit", started.Audit, c.Audit},
+		{"slowlog", started.SlowLog, c.SlowLog},
+		{"fetch", started.Fetch, c.Fetch},
+		{"reserves", started.Reserves, c.Reserves},
+		{"etcd", started.EtcdConfig, c.EtcdConfig},
+		{"redis", started.RedisConfig, c.RedisConfig},
+		{"sqlite", started.SQLiteConfig, c.SQLiteConfig},
+	}
+	var restart []string
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.a, setting.b) {
+			restart = append(restart, setting.name)
+		}
+	}
+	return restart
+}
+
+func checkBatch(batch int64) error {
+	if batch < 0 || batch > MaxStep {
+		return fmt.Errorf("batch:%d:out of range", batch)
+	}
+	return nil
+}
+
+// updateBatch sets the batch of the keys without a step to the batch of
+// the server, the keys whose step can not be read keep their batch.
+func (s *Server) updateBatch() {
+	s.Lock()
+	idgens := make(map[string]*IdGenerator, len(s.keyGeneratorMap))
+	for key, idgen := range s.keyGeneratorMap {
+		idgens[key] = idgen
+	}
+	s.Unlock()
+
+	for key, idgen := range idgens {
+		batch, explicit, err := s.keyBatch(key)
+		if err != nil {
+			logger.Warn("read step of key error",
+				"key", key,
+				"err", err,
+			)
+			continue
+		}
+		if !explicit {
+			idgen.SetBatch(batch)
+		}
+	}
+}
+
+func (s *Server) currentACL() *ACL {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.acl
+}
+
+func (s *Server) currentLimiter() *Limiter {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.limiter
+}
+
+func (s *Server) currentCerts() *certLoader {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.certs
+}
+
+// getTLSConfig returns the config of the current certificates for the
+// client hello
+func (s *Server) getTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.currentCerts().getConfig(hello)
+}
+
+// redis command(config reload), the reply is the settings applied and the
+// settings which need a restart.
+func (s *Server) handleConfig(r *Request) Reply {
+	if r.HasArgument(0) == false {
+		return ErrNotEnoughArgs
+	}
+	if strings.ToUpper(string(r.Arguments[0])) != "RELOAD" {
+		return ErrMethodNotSupported
+	}
+	if len(r.Arguments) > 1 {
+		return ErrTooMuchArgs
+	}
+	result, err := s.ReloadConfig()
+	if err != nil {
+		r.logger().Error("reload config error",
+			"err", err,
+		)
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	values := make([][]byte, 0, len(result.Applied)+len(result.Restart))
+	for _, name := range result.Applied {
+		values = append(values, []byte("applied "+name))
+	}
+	for _, name := range result.Restart {
+		values = append(values, []byte("restart "+name))
+	}
+	return &MultiBulkReply{
+		values: values,
+	}
+}
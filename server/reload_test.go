@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flike/idgo/config"
+)
+
+func TestReload(t *testing.T) {
+	users := []*config.UserConfig{
+		{Name: "admin", Password: "secret", Commands: []string{"read", "allocate", "admin"}, Keys: []string{"*"}},
+		{Name: "order", Password: "pass", Commands: []string{"read", "allocate"}, Keys: []string{"order*"}},
+	}
+	quotas := []*config.QuotaConfig{{Key: "order*", Daily: 3}}
+	started := &config.Config{Addr: "127.0.0.1:6389", Users: users, Quotas: quotas}
+	s := newTestServer(t)
+	s.cfg, s.liveCfg = started, started
+	s.acl, _ = NewACL(users)
+	s.limiter, _ = NewLimiter(nil, quotas)
+
+	admin, order := &Client{}, &Client{}
+	do := func(c *Client, command string, args ...string) string {
+		r := newTestRequest(command, args...)
+		r.Client = c
+		return replyString(t, s.ServeRequest(r))
+	}
+	do(admin, "AUTH", "admin", "secret")
+	do(order, "AUTH", "order", "pass")
+	do(admin, "SET", "order_id", "10")
+	do(admin, "SET", "step_id", "10", "STEP", "10")
+	do(order, "GET", "order_id")
+
+	// an invalid config is not applied
+	for _, c := range []*config.Config{
+		{LogLevel: "verbose"},
+		{Batch: -1},
+		{Users: []*config.UserConfig{{Name: "a", Commands: []string{"all"}}}},
+		{Quotas: []*config.QuotaConfig{{Key: "a"}}},
+	} {
+		if _, err := s.Reload(c); err == nil {
+			t.Fatalf("expect error of %+v", c)
+		}
+	}
+	if s.liveCfg != started {
+		t.Fatal("expect the config is kept")
+	}
+
+	result, err := s.Reload(&config.Config{
+		Addr:     "127.0.0.1:6390",
+		LogLevel: "debug",
+		Batch:    100,
+		Users: []*config.UserConfig{
+			users[0],
+			{Name: "order", Password: "pass", Commands: []string{"read"}, Keys: []string{"order*"}},
+		},
+		Quotas: quotas,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := fmt.Sprint(result.Applied, result.Restart); got != "[log_level users batch] [addr]" {
+		t.Fatalf("unexpected result %s", got)
+	}
+	defer logLevel.Set(ParseLogLevel(""))
+
+	// the connection of the user gets the new permissions
+	if got := do(order, "GET", "order_id"); !strings.HasPrefix(got, "-ERR user order has no permission") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if _, _, batch := s.keyGeneratorMap["order_id"].Segment(); batch != 100 {
+		t.Fatalf("expect batch 100, got %d", batch)
+	}
+	if _, _, batch := s.keyGeneratorMap["step_id"].Segment(); batch != 10 {
+		t.Fatalf("expect batch 10, got %d", batch)
+	}
+
+	// the quota usages are kept by the new limiter
+	if _, err := s.Reload(&config.Config{
+		Addr:   "127.0.0.1:6390",
+		Batch:  100,
+		Users:  users,
+		Quotas: []*config.QuotaConfig{{Key: "order*", Daily: 2}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	do(order, "GET", "order_id")
+	if got := do(order, "GET", "order_id"); got != "-ERR daily quota exceeded for the key\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	s := newTestServer(t)
+	if got := replyString(t, s.ServeRequest(newTestRequest("CONFIG", "RELOAD"))); got[0] != '-' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	s.SetConfigLoader(func() (*config.Config, error) {
+		return &config.Config{MaxClients: 10, Batch: 500}, nil
+	})
+	got := replyString(t, s.ServeRequest(newTestRequest("CONFIG", "reload")))
+	if got != "*2\r\n$13\r\napplied batch\r\n$18\r\nrestart maxclients\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := replyString(t, s.ServeRequest(newTestRequest("CONFIG", "GET"))); got[0] != '-' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/flike/idgo/config"
+)
+
+func checkReserves(reserves []*config.ReserveConfig) error {
+	for _, c := range reserves {
+		if len(c.Key) == 0 {
+			return fmt.Errorf("reserves:have no key")
+		}
+		if _, err := path.Match(c.Key, ""); err != nil {
+			return fmt.Errorf("reserves:%s:invalid glob", c.Key)
+		}
+		if c.Size <= 0 || c.Size > MaxStep {
+			return fmt.Errorf("reserves:%s:size is out of range", c.Key)
+		}
+	}
+	return nil
+}
+
+// reserveSize returns the size of the reserve of key, 0 if the key has no
+// reserve. The keys fetched with a fixed batch can not have a reserve.
+func (s *Server) reserveSize(key string) int64 {
+	if s.cfg == nil || s.isFixedBatch(key) {
+		return 0
+	}
+	_, name, ok := splitNamespace(key)
+	if !ok {
+		return 0
+	}
+	for _, c := range s.cfg.Reserves {
+		if ok, _ := path.Match(c.Key, name); ok {
+			return c.Size
+		}
+	}
+	return 0
+}
+
+// isUnavailable returns true if err means the storage can not be reached
+func isUnavailable(err error) bool {
+	return errors.Is(err, ErrStorageUnavailable) || isRetryable(err)
+}
+
+// idRange is the ids (cur, max] of the reserve
+type idRange struct {
+	cur, max int64
+}
+
+// reserveCount returns the count of ids left in the reserve, it must be
+// called with the lock.
+func (m *IdGenerator) reserveCount() int64 {
+	var left int64
+	for _, r := range m.reserves {
+		left += r.max - r.cur
+	}
+	return left
+}
+
+// reserveNeed returns the count of reserve ids to fetch with the next
+// segment, the ids used from the reserve. It must be called with the lock.
+func (m *IdGenerator) reserveNeed() int64 {
+	return max(m.reserve-m.reserveCount(), 0)
+}
+
+// useReserve makes the next chunk of the reserve the segment after the
+// fetch failed with err, it returns false if the reserve can not be used.
+// It must be called with the lock.
+func (m *IdGenerator) useReserve(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || !isUnavailable(err) {
+		return false
+	}
+	if len(m.reserves) == 0 {
+		if m.degraded.Load() {
+			logger.Error("reserve of key is used up",
+				"key", m.key,
+				"err", err,
+			)
+		}
+		return false
+	}
+	r := &m.reserves[0]
+	n := min(m.batch, r.max-r.cur)
+	m.cur = r.cur
+	m.batchMax = r.cur + n
+	r.cur += n
+	if r.cur == r.max {
+		m.reserves = m.reserves[1:]
+	}
+	left := m.reserveCount()
+	m.setReserveLeft(left)
+	if !m.degraded.Swap(true) {
+		keyDegraded.WithLabelValues(m.key).Set(1)
+	}
+	logger.Error("storage unavailable, key degraded to reserve",
+		"key", m.key,
+		"reserve_left", left,
+		"err", err,
+	)
+	return true
+}
+
+// refillReserve adds the need ids after start fetched with the segment to
+// the reserve, the unused ids of the reserve are kept. It must be called
+// with the lock.
+func (m *IdGenerator) refillReserve(start int64, need int64) {
+	if m.degraded.Swap(false) {
+		keyDegraded.WithLabelValues(m.key).Set(0)
+		logger.Warn("storage recovered, reserve of key replenished",
+			"key", m.key,
+			"reserve", m.reserve,
+		)
+	}
+	if need == 0 {
+		return
+	}
+	m.reserves = append(m.reserves, idRange{cur: start, max: start + need})
+	m.setReserveLeft(m.reserveCount())
+}
+
+// clearReserve drops the reserve after the value of the key is changed.
+// It must be called with the lock.
+func (m *IdGenerator) clearReserve() {
+	m.reserves = nil
+	if m.reserve != 0 {
+		m.setReserveLeft(0)
+	}
+	if m.degraded.Swap(false) {
+		keyDegraded.WithLabelValues(m.key).Set(0)
+	}
+}
+
+func (m *IdGenerator) setReserveLeft(left int64) {
+	m.reserveLeft.Store(left)
+	reserveRemaining.WithLabelValues(m.key).Set(float64(left))
+}
+
+// Reserve returns true if the ids are issued from the reserve, and the
+// count of ids left in the reserve. It does not wait for a fetch.
+func (m *IdGenerator) Reserve() (bool, int64) {
+	return m.degraded.Load(), m.reserveLeft.Load()
+}
+
+// reserveInfo returns the lines of the Reserve section of INFO, the count
+// of keys with a reserve and every degraded key.
+func (s *Server) reserveInfo() []string {
+	s.Lock()
+	idgens := make(map[string]*IdGenerator, len(s.keyGeneratorMap))
+	for key, idgen := range s.keyGeneratorMap {
+		if idgen.reserve != 0 {
+			idgens[key] = idgen
+		}
+	}
+	s.Unlock()
+
+	keys := make([]string, 0, len(idgens))
+	for key := range idgens {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var degraded []string
+	for _, key := range keys {
+		ok, left := idgens[key].Reserve()
+		if !ok {
+			continue
+		}
+		ns, name, _ := splitNamespace(key)
+		degraded = append(degraded, "degraded_key:db"+strconv.Itoa(ns)+":"+name+",reserve_left="+strconv.FormatInt(left, 10))
+	}
+	lines := []string{
+		"reserve_keys:" + strconv.Itoa(len(keys)),
+		"degraded_keys:" + strconv.Itoa(len(degraded)),
+	}
+	return append(lines, degraded...)
+}
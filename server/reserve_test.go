@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flike/idgo/config"
+)
+
+// outageStore fails the fetches with err while err is set
+type outageStore struct {
+	SegmentStore
+	err error
+}
+
+func (s *outageStore) Fetch(key string, step int64) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.SegmentStore.Fetch(key, step)
+}
+
+func TestReserve(t *testing.T) {
+	store := &outageStore{SegmentStore: openTestSQLiteStore(t)}
+	store.Reset("order", 0, false)
+	idgen, err := NewIdGenerator(store, "order", 3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	idgen.reserve = 5
+
+	next := func(want int64) {
+		t.Helper()
+		id, err := idgen.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if id != want {
+			t.Fatalf("expect id %d, got %d", want, id)
+		}
+	}
+	// the reserve (3, 8] is fetched with the segment
+	next(1)
+	if degraded, left := idgen.Reserve(); degraded || left != 5 {
+		t.Fatalf("unexpected reserve %v %d", degraded, left)
+	}
+
+	// the errors which are not an outage do not use the reserve
+	store.err = errors.New("order:have no id key")
+	next(2)
+	next(3)
+	if _, err := idgen.Next(); err != store.err {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	store.err = io.ErrUnexpectedEOF
+	for id := int64(4); id <= 8; id++ {
+		next(id)
+	}
+	if degraded, left := idgen.Reserve(); !degraded || left != 0 {
+		t.Fatalf("unexpected reserve %v %d", degraded, left)
+	}
+	if _, err := idgen.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the storage is back, the reserve is replenished
+	store.err = nil
+	next(9)
+	if degraded, left := idgen.Reserve(); degraded || left != 5 {
+		t.Fatalf("unexpected reserve %v %d", degraded, left)
+	}
+	if cur, _ := store.Current("order"); cur != 16 {
+		t.Fatalf("expect high-water mark 16, got %d", cur)
+	}
+}
+
+func TestReserveFetchedOnce(t *testing.T) {
+	store := &outageStore{SegmentStore: openTestSQLiteStore(t)}
+	store.Reset("order", 0, false)
+	idgen, err := NewIdGenerator(store, "order", 3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	idgen.reserve = 5
+
+	next := func(want int64) {
+		t.Helper()
+		if id, err := idgen.Next(); err != nil || id != want {
+			t.Fatalf("expect id %d, got %d %v", want, id, err)
+		}
+	}
+	// the reserve (3, 8] is fetched with the first segment only, the ids of
+	// the next segments have no gap
+	for id := int64(1); id <= 3; id++ {
+		next(id)
+	}
+	for id := int64(9); id <= 35; id++ {
+		next(id)
+	}
+	if cur, _ := store.Current("order"); cur != 35 {
+		t.Fatalf("expect high-water mark 35, got %d", cur)
+	}
+
+	// only the ids used from the reserve are fetched again, the rest of
+	// the reserve is kept
+	store.err = io.ErrUnexpectedEOF
+	next(4)
+	store.err = nil
+	next(5)
+	next(6)
+	next(36)
+	if _, left := idgen.Reserve(); left != 5 {
+		t.Fatalf("expect reserve 5, got %d", left)
+	}
+	if cur, _ := store.Current("order"); cur != 35+3+3 {
+		t.Fatalf("expect high-water mark 41, got %d", cur)
+	}
+	store.err = io.ErrUnexpectedEOF
+	for _, id := range []int64{37, 38, 7, 8, 39, 40, 41} {
+		next(id)
+	}
+}
+
+func TestReserveInfo(t *testing.T) {
+	if err := checkReserves([]*config.ReserveConfig{{Key: "order", Size: 0}}); err == nil {
+		t.Fatal("expect error of size out of range")
+	}
+	s := newTestServer(t)
+	s.cfg = &config.Config{Reserves: []*config.ReserveConfig{{Key: "order*", Size: 100}}}
+	if size := s.reserveSize(namespaceKey(1, "order_id")); size != 100 {
+		t.Fatalf("expect reserve 100, got %d", size)
+	}
+	if size := s.reserveSize("user_id"); size != 0 {
+		t.Fatalf("expect no reserve, got %d", size)
+	}
+
+	for _, key := range []string{"order_id", "user_id"} {
+		if got := replyString(t, s.ServeRequest(newTestRequest("SET", key, "0"))); got != "+OK\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+		if got := replyString(t, s.ServeRequest(newTestRequest("GET", key))); got != "$1\r\n1\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	s.keyGeneratorMap["order_id"].degraded.Store(true)
+	info := replyString(t, s.ServeRequest(newTestRequest("INFO", "reserve")))
+	for _, line := range []string{"reserve_keys:1", "degraded_keys:1", "degraded_key:db0:order_id,reserve_left=100"} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("unexpected info %q", info)
+		}
+	}
+}
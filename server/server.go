@@ -1,155 +1,298 @@
 package server
 
 import (
-	"database/sql"
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/flike/golog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/flike/idgo/config"
 )
 
-const (
-	KeyRecordTableName         = "__idgo__"
-	CreateRecordTableSQLFormat = `
-	CREATE TABLE %s (
-    k VARCHAR(255) NOT NULL,
-    PRIMARY KEY (k)
-) ENGINE=Innodb DEFAULT CHARSET=utf8 `
-
-	// create key table if not exist
-	CreateRecordTableNTSQLFormat = `
-	CREATE TABLE IF NOT EXISTS %s (
-    k VARCHAR(255) NOT NULL,
-    PRIMARY KEY (k)
-) ENGINE=Innodb DEFAULT CHARSET=utf8 `
-
-	InsertKeySQLFormat  = "INSERT INTO %s (k) VALUES ('%s')"
-	SelectKeySQLFormat  = "SELECT k FROM %s WHERE k = '%s'"
-	SelectKeysSQLFormat = "SELECT k FROM %s"
-	DeleteKeySQLFormat  = "DELETE FROM %s WHERE k = '%s'"
-)
-
 type Server struct {
 	cfg *config.Config
 
 	listener        net.Listener
-	db              *sql.DB
-	keyGeneratorMap map[string]*MySQLIdGenerator
+	store           SegmentStore
+	keyGeneratorMap map[string]*IdGenerator
+	keyChecks       map[string]keyCheck // the cached lookups of the key registry
+	acl             *ACL
+	certs           *certLoader
+	audit           *Auditor
+	slowlog         *SlowLog
+	monitors        monitorHub
+	limiter         *Limiter
+	startTime       time.Time
+	clients         atomic.Int64
+	commands        atomic.Int64
+	httpServer      *http.Server
+	healthServer    *http.Server
+	stopTracing     func() error
+	batch           atomic.Int64 // the batch of the keys without a step
+	fetcher         *Fetcher
+	initialized     atomic.Bool // Init has completed
+	closed          atomic.Bool
+	coldLock        sync.Mutex
+	coldKeys        map[string]bool // the keys failed to warm up
+
+	// reloadMu serializes the reloads, reloadLock guards acl, limiter
+	// and certs replaced by a reload
+	reloadMu     sync.Mutex
+	reloadLock   sync.RWMutex
+	liveCfg      *config.Config // the config last applied
+	configLoader func() (*config.Config, error)
+
 	sync.RWMutex
 	running bool
 }
 
-func NewServer(c *config.Config) (*Server, error) {
+func NewServer(c *config.Config) (_ *Server, err error) {
 	s := new(Server)
 	s.cfg = c
+	s.startTime = time.Now()
+	s.liveCfg = c
 
-	var err error
-	// init db
-	proto := "mysql"
-	charset := "utf8"
-	// root:@tcp(127.0.0.1:3306)/test?charset=utf8
-	url := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?%s",
-		c.DatabaseConfig.User,
-		c.DatabaseConfig.Password,
-		c.DatabaseConfig.Host,
-		c.DatabaseConfig.Port,
-		c.DatabaseConfig.DBName,
-		charset,
-	)
+	if err := checkBatch(c.Batch); err != nil {
+		return nil, err
+	}
+	s.batch.Store(c.Batch)
+	s.fetcher = NewFetcher(c.Fetch)
+	if err := checkReserves(c.Reserves); err != nil {
+		return nil, err
+	}
+	if len(c.HealthAddr) != 0 && c.HealthAddr == c.MetricsAddr {
+		return nil, fmt.Errorf("health_addr:%s:same as metrics_addr", c.HealthAddr)
+	}
+	s.acl, err = NewACL(c.Users)
+	if err != nil {
+		return nil, err
+	}
+	s.limiter, err = NewLimiter(c.RateLimits, c.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	// release what is opened so far if any step below fails
+	defer func() {
+		if err != nil {
+			s.release()
+		}
+	}()
+	s.stopTracing, err = initTracing(c.Tracing)
+	if err != nil {
+		return nil, err
+	}
 
-	s.db, err = sql.Open(proto, url)
+	// init storage
+	s.store, err = NewSegmentStore(c)
 	if err != nil {
-		golog.Error("main", "NewServer", "open database error", 0,
-			"err", err.Error(),
+		logger.Error("open storage error",
+			"storage", c.Storage,
+			"err", err,
 		)
 		return nil, err
 	}
 
+	if c.Audit != nil {
+		s.audit, err = newAuditor(c.Audit, s.store)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.slowlog = NewSlowLog(c.SlowLog)
+
 	netProto := "tcp"
-	s.listener, err = net.Listen(netProto, s.cfg.Addr)
+	s.listener, err = listen(s.cfg.Addr, newConnConfig(c).keepAlive)
 	if err != nil {
 		return nil, err
 	}
-	s.keyGeneratorMap = make(map[string]*MySQLIdGenerator)
+	if c.TLS != nil {
+		s.certs, err = newCertLoader(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.listener = tls.NewListener(s.listener, &tls.Config{
+			GetConfigForClient: s.getTLSConfig,
+		})
+		netProto = "tcp+tls"
+	}
+	s.keyGeneratorMap = make(map[string]*IdGenerator)
+	if len(c.MetricsAddr) != 0 {
+		err = s.serveMetrics(c.MetricsAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.HealthAddr) != 0 {
+		err = s.serveHealth(c.HealthAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	golog.Info("server", "NewServer", "Server running", 0,
-		"netProto",
-		netProto,
-		"address",
-		s.cfg.Addr,
+	logger.Info("server running",
+		"net_proto", netProto,
+		"address", s.cfg.Addr,
 	)
 
 	return s, nil
 }
 
 func (s *Server) Init() error {
-	createTableNtSQL := fmt.Sprintf(CreateRecordTableNTSQLFormat, KeyRecordTableName)
-	selectKeysSQL := fmt.Sprintf(SelectKeysSQLFormat, KeyRecordTableName)
-	_, err := s.db.Exec(createTableNtSQL)
+	err := s.store.Init()
 	if err != nil {
 		return err
 	}
-	rows, err := s.db.Query(selectKeysSQL)
+	keys, err := s.store.Keys()
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		idGenKey := ""
-		err := rows.Scan(&idGenKey)
-		if err != nil {
-			return err
+	for _, idGenKey := range keys {
+		ns, key, ok := splitNamespace(idGenKey)
+		if !ok || !IsValidKey(key) || ns >= s.namespaces() {
+			logger.Warn("skip invalid key",
+				"key", idGenKey,
+			)
+			continue
 		}
-		if idGenKey != "" {
-			idgen, ok := s.keyGeneratorMap[idGenKey]
-			if ok == false {
-				isExist, err := s.IsKeyExist(idGenKey)
+		idgen, ok := s.keyGeneratorMap[idGenKey]
+		if ok == false {
+			isExist, err := s.store.IsKeyExist(idGenKey)
+			if err != nil {
+				return err
+			}
+			if isExist {
+				idgen, err = s.newIdGenerator(idGenKey)
 				if err != nil {
 					return err
 				}
-				if isExist {
-					idgen, err = NewMySQLIdGenerator(s.db, idGenKey, BatchCount)
-					if err != nil {
-						return err
-					}
-					s.keyGeneratorMap[idGenKey] = idgen
-				}
+				s.keyGeneratorMap[idGenKey] = idgen
 			}
 		}
 	}
+	if s.cfg != nil && s.cfg.WarmSegments {
+		s.warmSegments()
+	}
+	s.initialized.Store(true)
 	return nil
 }
 
+func (s *Server) namespaces() int {
+	if s.cfg == nil {
+		return DefaultNamespaces
+	}
+	return namespaceCount(s.cfg.Namespaces)
+}
+
+// namespaceCount returns the count of namespaces configured by n
+func namespaceCount(n int) int {
+	if n <= 0 {
+		return DefaultNamespaces
+	}
+	return n
+}
+
+func (s *Server) storageName() string {
+	if s.cfg == nil || len(s.cfg.Storage) == 0 {
+		return StorageMySQL
+	}
+	return s.cfg.Storage
+}
+
+func (s *Server) newIdGenerator(key string) (*IdGenerator, error) {
+	batch, _, err := s.keyBatch(key)
+	if err != nil {
+		return nil, err
+	}
+	idgen, err := NewIdGenerator(s.store, key, batch)
+	if err != nil {
+		return nil, err
+	}
+	idgen.fetcher = s.fetcher
+	idgen.reserve = s.reserveSize(key)
+	idgen.checkInterval = s.keyCheckInterval()
+	return idgen, nil
+}
+
+// keyBatch returns the batch of key, explicit is true if it is fixed by
+// the store or set by the step of the key.
+func (s *Server) keyBatch(key string) (batch int64, explicit bool, err error) {
+	if b, ok := s.store.(BatchSizer); ok && b.BatchSize(key) != 0 {
+		return b.BatchSize(key), true, nil
+	}
+	if st, ok := s.store.(StepStore); ok {
+		step, err := st.Step(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if step > 0 {
+			return step, true, nil
+		}
+	}
+	if batch = s.batch.Load(); batch == 0 {
+		batch = BatchCount
+	}
+	return batch, false, nil
+}
+
+// isFixedBatch returns true if the batch of key is fixed by the store
+func (s *Server) isFixedBatch(key string) bool {
+	b, ok := s.store.(BatchSizer)
+	return ok && b.BatchSize(key) != 0
+}
+
 func (s *Server) Serve() error {
+	cc := newConnConfig(s.cfg)
 	s.running = true
 	for s.running {
 		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			golog.Error("server", "Run", err.Error(), 0)
+			logger.Error("accept error",
+				"err", err,
+			)
+			continue
+		}
+		if !s.acquireClient(cc.maxClients) {
+			logger.Warn("max number of clients reached",
+				"client", conn.RemoteAddr().String(),
+				"maxclients", cc.maxClients,
+			)
+			go rejectClient(conn)
 			continue
 		}
 
-		go s.onConn(conn)
+		go func() {
+			defer s.clients.Add(-1)
+			s.onConn(conn)
+		}()
 	}
 	return nil
 }
 
 func (s *Server) onConn(conn net.Conn) error {
+	client := newClient(conn, s.currentACL())
 	defer func() {
-		clientAddr := conn.RemoteAddr().String()
 		r := recover()
 		if err, ok := r.(error); ok {
 			const size = 4096
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)] // 获得当前goroutine的stacktrace
-			golog.Error("server", "onConn", "error", 0,
-				"remoteAddr", clientAddr,
+			client.log.Error("panic",
 				"stack", string(buf),
-				"err", err.Error(),
+				"err", err,
 			)
 			reply := &ErrorReply{
 				message: err.Error(),
@@ -159,24 +302,149 @@ func (s *Server) onConn(conn net.Conn) error {
 		conn.Close()
 	}()
 
+	connectedClients.Inc()
+	defer connectedClients.Dec()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			client.log.Warn("tls handshake error",
+				"err", err,
+			)
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		client.setCertificate(tlsConn, s.currentACL())
+	}
+	client.log.Info("client connected",
+		"cert_subject", client.CertSubject,
+		"user", client.UserName(),
+	)
+	cc := newConnConfig(s.cfg)
+	reader := bufio.NewReader(conn)
 	for {
-		request, err := NewRequest(conn)
+		// wait for the next request within the idle timeout, then read
+		// the whole request within the read timeout
+		conn.SetReadDeadline(deadline(cc.idleTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			if isTimeout(err) {
+				connectionTimeouts.WithLabelValues("idle").Inc()
+				client.log.Debug("idle timeout")
+			} else if err != io.EOF {
+				client.log.Warn("read request error",
+					"err", err,
+				)
+			}
+			return err
+		}
+		conn.SetReadDeadline(deadline(cc.readTimeout))
+		request, err := ReadRequest(reader, cc.limits)
 		if err != nil {
+			s.readRequestError(conn, client, err, cc.writeTimeout)
 			return err
 		}
+		request.Connection = conn
+		request.RemoteAddress = client.RemoteAddress
+		request.Client = client
 
 		reply := s.ServeRequest(request)
+		conn.SetWriteDeadline(deadline(cc.writeTimeout))
 		if _, err := reply.WriteTo(conn); err != nil {
-			golog.Error("server", "onConn", "reply write error", 0,
-				"err", err.Error())
+			if isTimeout(err) {
+				connectionTimeouts.WithLabelValues("write").Inc()
+			}
+			client.log.Error("reply write error",
+				"req_id", request.ID,
+				"err", err,
+			)
 			return err
 		}
+		if client.Monitoring {
+			return s.serveMonitor(conn, client, cc.writeTimeout)
+		}
+	}
+}
 
+// readRequestError counts and logs the error of reading a request, the
+// request over the limits gets the error reply.
+func (s *Server) readRequestError(conn net.Conn, client *Client, err error, writeTimeout time.Duration) {
+	switch {
+	case err == io.EOF:
+		return
+	case err == io.ErrUnexpectedEOF:
+		client.log.Debug("connection closed in a request")
+		return
+	case isTimeout(err):
+		connectionTimeouts.WithLabelValues("read").Inc()
+		client.log.Warn("read request timeout")
+		return
+	}
+
+	protocolErrors.Inc()
+	client.log.Warn("read request error",
+		"err", err,
+	)
+	if errReply, ok := err.(*ErrorReply); ok {
+		switch errReply {
+		case ErrInvalidMultibulkLength:
+			requestLimitsExceeded.WithLabelValues("args").Inc()
+		case ErrInvalidBulkLength:
+			requestLimitsExceeded.WithLabelValues("bulk_length").Inc()
+		case ErrLineTooLong:
+			requestLimitsExceeded.WithLabelValues("line_length").Inc()
+		}
+		conn.SetWriteDeadline(deadline(writeTimeout))
+		errReply.WriteTo(conn)
 	}
-	return nil
 }
 
 func (s *Server) ServeRequest(request *Request) Reply {
+	start := time.Now()
+	request.ID = requestIDs.Add(1)
+	command := commandLabel(request.Command)
+	ctx, span := tracer.Start(request.Context(), "idgo."+command, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("idgo.command", request.Command),
+			attribute.Int64("idgo.request_id", int64(request.ID)),
+			attribute.String("net.peer.address", request.RemoteAddress),
+			attribute.Int("idgo.namespace", request.Namespace()),
+		))
+	if cc, ok := commandClasses[request.Command]; ok && cc.hasKey && request.HasArgument(0) {
+		span.SetAttributes(keyAttribute(string(request.Arguments[0])))
+	}
+	timing := new(requestTiming)
+	request.ctx = withRequestTiming(ctx, timing)
+
+	reply := s.serveRequest(request)
+
+	var err error
+	if errReply, ok := reply.(*ErrorReply); ok {
+		err = errReply
+	}
+	endSpan(span, err)
+	latency := time.Since(start)
+	s.commands.Add(1)
+	commandsTotal.WithLabelValues(command).Inc()
+	commandDuration.WithLabelValues(command).Observe(latency.Seconds())
+	logRequest(request, reply, latency)
+	if s.slowlog != nil {
+		s.slowlog.Add(request, latency, timing)
+	}
+	return reply
+}
+
+func (s *Server) serveRequest(request *Request) Reply {
+	if errReply := s.checkAccess(request); errReply != nil {
+		return errReply
+	}
+	// the monitors only see the commands the client is allowed to run
+	s.monitors.feed(request)
+	if limiter := s.currentLimiter(); limiter != nil && request.Command != "AUTH" {
+		if errReply := limiter.AllowClient(request); errReply != nil {
+			return errReply
+		}
+	}
+
 	switch request.Command {
 	case "GET":
 		return s.handleGet(request)
@@ -188,96 +456,116 @@ func (s *Server) ServeRequest(request *Request) Reply {
 		return s.handleDel(request)
 	case "SELECT":
 		return s.handleSelect(request)
+	case "AUTH":
+		return s.handleAuth(request)
+	case "HEALTH":
+		return s.handleHealth(request)
+	case "ACL":
+		return s.handleACL(request)
+	case "AUDIT":
+		return s.handleAudit(request)
+	case "SLOWLOG":
+		return s.handleSlowLog(request)
+	case "MONITOR":
+		return s.handleMonitor(request)
+	case "INFO":
+		return s.handleInfo(request)
+	case "KEYS":
+		return s.handleKeys(request)
+	case "DESCRIBE":
+		return s.handleDescribe(request)
+	case "CONFIG":
+		return s.handleConfig(request)
 	default:
 		return ErrMethodNotSupported
 	}
-
-	return nil
 }
 
-func (s *Server) Close() {
-	s.running = false
-	if s.listener != nil {
-		s.listener.Close()
-	}
-	golog.Info("server", "close", "server closed!", 0)
-}
-
-func (s *Server) IsKeyExist(key string) (bool, error) {
-	var tableName string
-	var haveValue bool
-	if len(key) == 0 {
-		return false, nil
-	}
-	getKeySQL := fmt.Sprintf(GetKeySQLFormat, key)
-	rows, err := s.db.Query(getKeySQL)
-	if err != nil {
-		return false, err
+// checkAccess checks the user of the request can run the command
+// on the key, every command except AUTH and HEALTH needs an authenticated user.
+func (s *Server) checkAccess(r *Request) *ErrorReply {
+	acl := s.currentACL()
+	if acl == nil || r.Command == "AUTH" || r.Command == "HEALTH" {
+		return nil
 	}
-	defer rows.Close()
-	for rows.Next() {
-		err := rows.Scan(&tableName)
-		if err != nil {
-			return false, err
+	var user *User
+	if r.Client != nil {
+		user = r.Client.User
+		// the user of the connection is updated or removed by a reload
+		if user != nil && user != acl.users[user.Name] {
+			user = acl.users[user.Name]
+			r.Client.User = user
 		}
-		haveValue = true
 	}
-	if haveValue == false {
-		return false, nil
+	if user == nil {
+		return ErrNoAuth
 	}
-	return true, nil
-}
 
-func (s *Server) GetKey(key string) (string, error) {
-	keyName := ""
-	selectKeySQL := fmt.Sprintf(SelectKeySQLFormat, KeyRecordTableName, key)
-	rows, err := s.db.Query(selectKeySQL)
-	if err != nil {
-		return keyName, err
+	cc, ok := commandClasses[r.Command]
+	if !ok {
+		return nil
 	}
-	defer rows.Close()
-	for rows.Next() {
-		err := rows.Scan(&keyName)
-		if err != nil {
-			return keyName, err
-		}
+	// the namespace of the connection may be removed from the user by a reload
+	if !user.CanUseNamespace(r.Namespace()) {
+		return namespaceDenied(user, r.Namespace())
+	}
+	key := ""
+	if cc.hasKey && r.HasArgument(0) {
+		key = string(r.Arguments[0])
 	}
-	if keyName == "" {
-		return keyName, fmt.Errorf("%s:not exists key", key)
+	if !user.CanAccess(cc.class, key) {
+		r.logger().Warn("no permission",
+			"user", user.Name,
+			"command", r.Command,
+			"key", key,
+		)
+		return &ErrorReply{
+			message: fmt.Sprintf("user %s has no permission to run %s on this key", user.Name, r.Command),
+		}
 	}
-	return keyName, nil
+	return nil
 }
 
-func (s *Server) SetKey(key string) error {
-	if len(key) == 0 {
-		return fmt.Errorf("%s:invalid key", key)
+func namespaceDenied(user *User, ns int) *ErrorReply {
+	return &ErrorReply{
+		message: fmt.Sprintf("user %s has no permission to access namespace %d", user.Name, ns),
 	}
-	_, err := s.GetKey(key)
-	if err == nil {
-		return nil
-	} else {
-		insertKeySQL := fmt.Sprintf(InsertKeySQLFormat, KeyRecordTableName, key)
-		_, err = s.db.Exec(insertKeySQL)
-		if err != nil {
-			return err
-		}
+}
+
+// ReloadTLS reloads the certificate files of the listener.
+func (s *Server) ReloadTLS() error {
+	certs := s.currentCerts()
+	if certs == nil {
 		return nil
 	}
+	return certs.Reload()
 }
 
-func (s *Server) DelKey(key string) error {
-	if len(key) == 0 {
-		return fmt.Errorf("%s:invalid key", key)
+func (s *Server) Close() {
+	s.running = false
+	s.closed.Store(true)
+	s.release()
+	logger.Info("server closed")
+}
+
+// release closes the listeners, the tracing, the storage and the auditor
+func (s *Server) release() {
+	if s.listener != nil {
+		s.listener.Close()
 	}
-	_, err := s.GetKey(key)
-	if err == nil {
-		deletetKeySQL := fmt.Sprintf(DeleteKeySQLFormat, KeyRecordTableName, key)
-		_, err = s.db.Exec(deletetKeySQL)
-		if err != nil {
-			return err
-		}
-		return nil
-	} else {
-		return nil
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if s.healthServer != nil {
+		s.healthServer.Close()
+	}
+	if s.stopTracing != nil {
+		s.stopTracing()
+	}
+	if s.store != nil {
+		s.store.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
 	}
 }
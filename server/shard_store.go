@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	PlacementHash = "hash"
+	PlacementMap  = "map"
+
+	// virtual nodes of every shard on the hash ring
+	ShardVirtualNodes = 160
+)
+
+// Shard is a named SegmentStore of a ShardStore.
+type Shard struct {
+	Name  string
+	Store SegmentStore
+}
+
+// ShardStore places every key on one of the shards, and forwards the
+// operations of the key to that shard. The placement of a key must be
+// stable, a key placed on another shard loses its high-water mark.
+type ShardStore struct {
+	shards map[string]SegmentStore
+	names  []string
+
+	policy  string
+	keys    map[string]string // key -> shard name
+	dflt    string
+	ring    []uint32
+	ringMap map[uint32]string // hash -> shard name
+}
+
+func NewMySQLShardStore(dbs []*config.DBConfig, p *config.PlacementConfig) (*ShardStore, error) {
+	shards := make([]Shard, 0, len(dbs))
+	for i, c := range dbs {
+		store, err := NewMySQLStore(c)
+		if err != nil {
+			for _, shard := range shards {
+				shard.Store.Close()
+			}
+			return nil, err
+		}
+		name := c.Name
+		if len(name) == 0 {
+			name = strconv.Itoa(i)
+		}
+		shards = append(shards, Shard{Name: name, Store: store})
+	}
+	s, err := NewShardStore(shards, p)
+	if err != nil {
+		for _, shard := range shards {
+			shard.Store.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewShardStore(shards []Shard, p *config.PlacementConfig) (*ShardStore, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("shard:have no storage")
+	}
+	if p == nil {
+		p = &config.PlacementConfig{Policy: PlacementHash}
+	}
+	s := &ShardStore{
+		shards: make(map[string]SegmentStore),
+		policy: p.Policy,
+		keys:   p.Keys,
+		dflt:   p.Default,
+	}
+	for _, shard := range shards {
+		if _, ok := s.shards[shard.Name]; ok {
+			return nil, fmt.Errorf("%s:duplicate shard name", shard.Name)
+		}
+		s.shards[shard.Name] = shard.Store
+		s.names = append(s.names, shard.Name)
+	}
+
+	switch s.policy {
+	case "", PlacementHash:
+		s.policy = PlacementHash
+		s.buildRing()
+	case PlacementMap:
+		if _, ok := s.shards[s.dflt]; !ok {
+			return nil, fmt.Errorf("%s:invalid default shard", s.dflt)
+		}
+		for key, name := range s.keys {
+			if _, ok := s.shards[name]; !ok {
+				return nil, fmt.Errorf("%s:invalid shard of key %s", name, key)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s:invalid placement policy", s.policy)
+	}
+	return s, nil
+}
+
+func (s *ShardStore) buildRing() {
+	s.ringMap = make(map[uint32]string)
+	for _, name := range s.names {
+		for i := 0; i < ShardVirtualNodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+			s.ringMap[h] = name
+			s.ring = append(s.ring, h)
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i] < s.ring[j] })
+}
+
+// ShardName returns the name of the shard which key is placed on.
+func (s *ShardStore) ShardName(key string) string {
+	if s.policy == PlacementMap {
+		// the keys of all namespaces are placed by the key name
+		if _, k, ok := splitNamespace(key); ok {
+			key = k
+		}
+		if name, ok := s.keys[key]; ok {
+			return name
+		}
+		return s.dflt
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i] >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ringMap[s.ring[i]]
+}
+
+// Backend is the shard of key
+func (s *ShardStore) Backend(key string) string {
+	return s.ShardName(key)
+}
+
+func (s *ShardStore) shard(key string) SegmentStore {
+	return s.shards[s.ShardName(key)]
+}
+
+func (s *ShardStore) Init() error {
+	for _, name := range s.names {
+		if err := s.shards[name].Init(); err != nil {
+			return fmt.Errorf("shard %s:%v", name, err)
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys of all shards, the keys registered on a shard
+// which they are not placed on are skipped.
+func (s *ShardStore) Keys() ([]string, error) {
+	keys := make([]string, 0)
+	for _, name := range s.names {
+		shardKeys, err := s.shards[name].Keys()
+		if err != nil {
+			return nil, fmt.Errorf("shard %s:%v", name, err)
+		}
+		for _, key := range shardKeys {
+			if s.ShardName(key) != name {
+				logger.Warn("key is not placed on this shard",
+					"key", key,
+					"shard", name,
+				)
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *ShardStore) IsKeyExist(key string) (bool, error) {
+	return s.shard(key).IsKeyExist(key)
+}
+
+func (s *ShardStore) Current(key string) (int64, error) {
+	return s.shard(key).Current(key)
+}
+
+func (s *ShardStore) Fetch(key string, step int64) (int64, error) {
+	return s.shard(key).Fetch(key, step)
+}
+
+func (s *ShardStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	return fetchContext(ctx, s.shard(key), key, step)
+}
+
+func (s *ShardStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	return s.shard(key).Reset(key, idOffset, force)
+}
+
+func (s *ShardStore) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+func (s *ShardStore) BatchSize(key string) int64 {
+	if b, ok := s.shard(key).(BatchSizer); ok {
+		return b.BatchSize(key)
+	}
+	return 0
+}
+
+func (s *ShardStore) Step(key string) (int64, error) {
+	if st, ok := s.shard(key).(StepStore); ok {
+		return st.Step(key)
+	}
+	return 0, nil
+}
+
+func (s *ShardStore) SetStep(key string, step int64) error {
+	if st, ok := s.shard(key).(StepStore); ok {
+		return st.SetStep(key, step)
+	}
+	return fmt.Errorf("%s:the storage of the key has no step", key)
+}
+
+func (s *ShardStore) Generation(key string) (int64, error) {
+	if gs, ok := s.shard(key).(GenerationStore); ok {
+		return gs.Generation(key)
+	}
+	return 0, nil
+}
+
+func (s *ShardStore) BumpGeneration(key string) error {
+	if gs, ok := s.shard(key).(GenerationStore); ok {
+		return gs.BumpGeneration(key)
+	}
+	return nil
+}
+
+func (s *ShardStore) DBs() map[string]*sql.DB {
+	dbs := make(map[string]*sql.DB)
+	for _, name := range s.names {
+		if d, ok := s.shards[name].(DBStore); ok {
+			for dbName, db := range d.DBs() {
+				dbs[name+"/"+dbName] = db
+			}
+		}
+	}
+	return dbs
+}
+
+// Ping checks every shard is reachable
+func (s *ShardStore) Ping(ctx context.Context) error {
+	for _, name := range s.names {
+		if err := pingStore(ctx, s.shards[name]); err != nil {
+			return fmt.Errorf("shard %s:%v", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardStore) Close() error {
+	var err error
+	for _, name := range s.names {
+		if e := s.shards[name].Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/flike/idgo/config"
+)
+
+func newTestShardStore(t *testing.T, p *config.PlacementConfig, names ...string) *ShardStore {
+	shards := make([]Shard, 0, len(names))
+	for _, name := range names {
+		shards = append(shards, Shard{Name: name, Store: openTestSQLiteStore(t)})
+	}
+	store, err := NewShardStore(shards, p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return store
+}
+
+func TestShardHashPlacement(t *testing.T) {
+	store := newTestShardStore(t, nil, "db0", "db1", "db2")
+	count := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := store.Reset(key, 1, false); err != nil {
+			t.Fatal(err.Error())
+		}
+		name := store.ShardName(key)
+		count[name]++
+		exist, err := store.shards[name].IsKeyExist(key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !exist {
+			t.Fatalf("%s is not stored on %s", key, name)
+		}
+	}
+	for _, name := range []string{"db0", "db1", "db2"} {
+		if count[name] == 0 {
+			t.Fatalf("no key placed on %s: %v", name, count)
+		}
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 300 {
+		t.Fatalf("expect 300 keys, got %d", len(keys))
+	}
+
+	// adding a shard only moves the keys placed on it
+	grown := newTestShardStore(t, nil, "db0", "db1", "db2", "db3")
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		name := grown.ShardName(key)
+		if name != "db3" && name != store.ShardName(key) {
+			t.Fatalf("%s moved from %s to %s", key, store.ShardName(key), name)
+		}
+	}
+}
+
+func TestShardMapPlacement(t *testing.T) {
+	p := &config.PlacementConfig{
+		Policy:  PlacementMap,
+		Keys:    map[string]string{"order": "db1"},
+		Default: "db0",
+	}
+	store := newTestShardStore(t, p, "db0", "db1")
+	if name := store.ShardName("order"); name != "db1" {
+		t.Fatalf("expect db1, got %s", name)
+	}
+	if name := store.ShardName("user"); name != "db0" {
+		t.Fatalf("expect db0, got %s", name)
+	}
+
+	idGenerator, err := NewIdGenerator(store, "order", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = idGenerator.Reset(100, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, err := idGenerator.Next(); err != nil || id != 101 {
+		t.Fatalf("next: %d %v", id, err)
+	}
+	if id, err := store.shards["db1"].Current("order"); err != nil || id != 110 {
+		t.Fatalf("db1 current: %d %v", id, err)
+	}
+	if exist, _ := store.shards["db0"].IsKeyExist("order"); exist {
+		t.Fatal("order should not be stored on db0")
+	}
+
+	// a key registered on a shard which it is not placed on is skipped
+	if _, err = store.shards["db0"].Reset("order", 1, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 1 || keys[0] != "order" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	p.Default = "db9"
+	if _, err = NewShardStore([]Shard{{Name: "db0", Store: openTestSQLiteStore(t)}}, p); err == nil {
+		t.Fatal("invalid default shard should fail")
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	DefaultSlowLogSlowerThan = 10000 // microsecond
+	DefaultSlowLogMaxLen     = 128
+	DefaultSlowLogGetCount   = 10
+
+	// like redis, only the first arguments and bytes of every argument are kept
+	SlowLogMaxArgc   = 32
+	SlowLogMaxArgLen = 128
+)
+
+// requestTiming is the time a request spent waiting for the lock of the
+// id generator and in the storage.
+type requestTiming struct {
+	lockWait atomic.Int64 // nanosecond
+	storage  atomic.Int64 // nanosecond
+}
+
+type requestTimingKey struct{}
+
+func withRequestTiming(ctx context.Context, t *requestTiming) context.Context {
+	return context.WithValue(ctx, requestTimingKey{}, t)
+}
+
+// addLockWait adds d to the lock wait time of the request in ctx
+func addLockWait(ctx context.Context, d time.Duration) {
+	if t, ok := ctx.Value(requestTimingKey{}).(*requestTiming); ok {
+		t.lockWait.Add(int64(d))
+	}
+}
+
+// addStorageTime adds d to the storage time of the request in ctx
+func addStorageTime(ctx context.Context, d time.Duration) {
+	if t, ok := ctx.Value(requestTimingKey{}).(*requestTiming); ok {
+		t.storage.Add(int64(d))
+	}
+}
+
+type SlowLogEntry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	LockWait time.Duration
+	Storage  time.Duration
+	Args     [][]byte // the command and the arguments
+	Client   string
+	User     string
+}
+
+// SlowLog keeps the latest requests slower than the threshold in a ring buffer.
+type SlowLog struct {
+	lock       sync.Mutex
+	slowerThan time.Duration // negative disables the slow log
+	entries    []*SlowLogEntry
+	next       int // the index of the next entry in entries
+	count      int
+	lastID     int64
+}
+
+func NewSlowLog(c *config.SlowLogConfig) *SlowLog {
+	l := &SlowLog{
+		slowerThan: DefaultSlowLogSlowerThan * time.Microsecond,
+		entries:    make([]*SlowLogEntry, DefaultSlowLogMaxLen),
+	}
+	if c != nil {
+		if c.LogSlowerThan != nil {
+			l.slowerThan = time.Duration(*c.LogSlowerThan) * time.Microsecond
+		}
+		if c.MaxLen > 0 {
+			l.entries = make([]*SlowLogEntry, c.MaxLen)
+		}
+	}
+	return l
+}
+
+// Add records the request if it is slower than the threshold.
+func (l *SlowLog) Add(r *Request, d time.Duration, t *requestTiming) {
+	if l.slowerThan < 0 || d < l.slowerThan {
+		return
+	}
+	e := &SlowLogEntry{
+		Time:     time.Now(),
+		Duration: d,
+		LockWait: time.Duration(t.lockWait.Load()),
+		Storage:  time.Duration(t.storage.Load()),
+		Client:   r.RemoteAddress,
+		Args:     slowLogArgs(r),
+	}
+	if r.Client != nil {
+		e.User = r.Client.UserName()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lastID++
+	e.ID = l.lastID
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.count < len(l.entries) {
+		l.count++
+	}
+}
+
+// Get returns the latest count entries, all the entries if count is negative.
+func (l *SlowLog) Get(count int) []*SlowLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if count < 0 || count > l.count {
+		count = l.count
+	}
+	entries := make([]*SlowLogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return entries
+}
+
+func (l *SlowLog) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.count
+}
+
+func (l *SlowLog) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.entries {
+		l.entries[i] = nil
+	}
+	l.next = 0
+	l.count = 0
+}
+
+// slowLogArgs copies the command and the arguments of r, the password of
+// AUTH is not kept.
+func slowLogArgs(r *Request) [][]byte {
+	args := [][]byte{[]byte(r.Command)}
+	if r.Command == "AUTH" {
+		return args
+	}
+	for i, arg := range r.Arguments {
+		// the last slot is kept for the count of the other arguments
+		if len(r.Arguments) >= SlowLogMaxArgc && i == SlowLogMaxArgc-2 {
+			more := len(r.Arguments) - i
+			args = append(args, []byte("... ("+strconv.Itoa(more)+" more arguments)"))
+			break
+		}
+		if len(arg) > SlowLogMaxArgLen {
+			more := len(arg) - SlowLogMaxArgLen
+			arg = append(arg[:SlowLogMaxArgLen:SlowLogMaxArgLen], []byte("... ("+strconv.Itoa(more)+" more bytes)")...)
+		} else {
+			arg = append([]byte{}, arg...)
+		}
+		args = append(args, arg)
+	}
+	return args
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+func slowerThan(us int64) *int64 {
+	return &us
+}
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog(&config.SlowLogConfig{LogSlowerThan: slowerThan(1000), MaxLen: 3})
+	timing := new(requestTiming)
+	addLockWait(withRequestTiming(context.Background(), timing), 2*time.Millisecond)
+
+	l.Add(newTestRequest("GET", "fast"), 999*time.Microsecond, timing)
+	if l.Len() != 0 {
+		t.Fatalf("expect no entry, got %d", l.Len())
+	}
+	for i := 0; i < 5; i++ {
+		l.Add(newTestRequest("GET", "key"+strconv.Itoa(i)), 3*time.Millisecond, timing)
+	}
+	if l.Len() != 3 {
+		t.Fatalf("expect 3 entries, got %d", l.Len())
+	}
+	entries := l.Get(-1)
+	if len(entries) != 3 || entries[0].ID != 5 || string(entries[0].Args[1]) != "key4" ||
+		entries[2].ID != 3 || entries[0].LockWait != 2*time.Millisecond {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries = l.Get(1); len(entries) != 1 || entries[0].ID != 5 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	l.Add(newTestRequest("AUTH", "admin", "secret"), time.Second, timing)
+	if args := l.Get(1)[0].Args; len(args) != 1 {
+		t.Fatalf("AUTH arguments are kept: %q", args)
+	}
+
+	l.Reset()
+	if l.Len() != 0 || len(l.Get(10)) != 0 {
+		t.Fatal("expect empty slow log after reset")
+	}
+	// the id is not reset like redis
+	l.Add(newTestRequest("GET", "key"), time.Second, timing)
+	if e := l.Get(1)[0]; e.ID != 7 {
+		t.Fatalf("unexpected id %d", e.ID)
+	}
+}
+
+func TestSlowLogSlowerThan(t *testing.T) {
+	// a section without log_slower_than keeps the default
+	if l := NewSlowLog(&config.SlowLogConfig{MaxLen: 3}); l.slowerThan != DefaultSlowLogSlowerThan*time.Microsecond {
+		t.Fatalf("unexpected threshold %v", l.slowerThan)
+	}
+	timing := new(requestTiming)
+	l := NewSlowLog(&config.SlowLogConfig{LogSlowerThan: slowerThan(0)})
+	l.Add(newTestRequest("GET", "key"), 0, timing)
+	if l.Len() != 1 {
+		t.Fatalf("expect 1 entry, got %d", l.Len())
+	}
+	l = NewSlowLog(&config.SlowLogConfig{LogSlowerThan: slowerThan(-1)})
+	l.Add(newTestRequest("GET", "key"), time.Second, timing)
+	if l.Len() != 0 {
+		t.Fatalf("expect no entry, got %d", l.Len())
+	}
+}
+
+func TestSlowLogArgs(t *testing.T) {
+	args := make([]string, 40)
+	for i := range args {
+		args[i] = strings.Repeat("a", 200)
+	}
+	got := slowLogArgs(newTestRequest("SET", args...))
+	if len(got) != SlowLogMaxArgc {
+		t.Fatalf("expect %d arguments, got %d", SlowLogMaxArgc, len(got))
+	}
+	if s := string(got[1]); s != strings.Repeat("a", 128)+"... (72 more bytes)" {
+		t.Fatalf("unexpected argument %q", s)
+	}
+	if s := string(got[SlowLogMaxArgc-1]); s != "... (10 more arguments)" {
+		t.Fatalf("unexpected argument %q", s)
+	}
+}
+
+func TestSlowLogCommand(t *testing.T) {
+	s := newTestServer(t)
+	s.slowlog = NewSlowLog(&config.SlowLogConfig{LogSlowerThan: slowerThan(0)})
+	s.ServeRequest(newTestRequest("SET", "slow_key", "1"))
+	s.ServeRequest(newTestRequest("GET", "slow_key"))
+
+	if got := replyString(t, s.ServeRequest(newTestRequest("SLOWLOG", "LEN"))); got != ":2\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// the SLOWLOG LEN is logged after it is served
+	got := replyString(t, s.ServeRequest(newTestRequest("SLOWLOG", "GET", "1")))
+	if !strings.HasPrefix(got, "*1\r\n*8\r\n:3\r\n") || !strings.Contains(got, "*2\r\n$7\r\nSLOWLOG\r\n$3\r\nLEN\r\n") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := replyString(t, s.ServeRequest(newTestRequest("SLOWLOG", "RESET"))); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the first GET fetches a segment from storage
+	s.ServeRequest(newTestRequest("SET", "slow_key2", "1"))
+	s.ServeRequest(newTestRequest("GET", "slow_key2"))
+	if e := s.slowlog.Get(1)[0]; e.Storage <= 0 || e.Storage > e.Duration {
+		t.Fatalf("unexpected storage time %+v", e)
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	// every key is a row of the record table in sqlite
+	CreateSQLiteRecordTableSQL = `
+	CREATE TABLE IF NOT EXISTS __idgo__ (
+    k TEXT NOT NULL PRIMARY KEY,
+    id INTEGER NOT NULL
+)`
+
+	CreateSQLiteStepTableSQL = `
+	CREATE TABLE IF NOT EXISTS __idgo_step__ (
+    k TEXT NOT NULL PRIMARY KEY,
+    step INTEGER NOT NULL
+)`
+
+	SQLiteSelectStepSQL  = "SELECT step FROM __idgo_step__ WHERE k = ?"
+	SQLiteReplaceStepSQL = "INSERT OR REPLACE INTO __idgo_step__ (k, step) VALUES (?, ?)"
+	SQLiteDeleteStepSQL  = "DELETE FROM __idgo_step__ WHERE k = ?"
+
+	CreateSQLiteGenerationTableSQL = `
+	CREATE TABLE IF NOT EXISTS __idgo_generation__ (
+    k TEXT NOT NULL PRIMARY KEY,
+    generation INTEGER NOT NULL
+)`
+
+	SQLiteSelectGenerationSQL = "SELECT generation FROM __idgo_generation__ WHERE k = ?"
+	SQLiteBumpGenerationSQL   = "INSERT INTO __idgo_generation__ (k, generation) VALUES (?, 1) ON CONFLICT(k) DO UPDATE SET generation = generation + 1"
+
+	SQLiteSelectKeysSQL       = "SELECT k FROM __idgo__"
+	SQLiteSelectIdSQL         = "SELECT id FROM __idgo__ WHERE k = ?"
+	SQLiteUpdateIdSQL         = "UPDATE __idgo__ SET id = id + ? WHERE k = ?"
+	SQLiteInsertIdSQL         = "INSERT OR IGNORE INTO __idgo__ (k, id) VALUES (?, ?)"
+	SQLiteReplaceIdSQL        = "INSERT OR REPLACE INTO __idgo__ (k, id) VALUES (?, ?)"
+	SQLiteDeleteKeySQL        = "DELETE FROM __idgo__ WHERE k = ?"
+	CreateSQLiteAuditTableSQL = `
+	CREATE TABLE IF NOT EXISTS __idgo_audit__ (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ts INTEGER NOT NULL,
+    user TEXT NOT NULL,
+    client TEXT NOT NULL,
+    command TEXT NOT NULL,
+    ns INTEGER NOT NULL,
+    k TEXT NOT NULL,
+    old_value INTEGER,
+    new_value INTEGER,
+    err TEXT NOT NULL
+);
+	CREATE INDEX IF NOT EXISTS idx_idgo_audit_ns_k ON __idgo_audit__ (ns, k)`
+
+	SQLiteInsertAuditSQL    = "INSERT INTO __idgo_audit__ (ts, user, client, command, ns, k, old_value, new_value, err) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	SQLiteSelectAuditSQL    = "SELECT id, ts, user, client, command, ns, k, old_value, new_value, err FROM __idgo_audit__ WHERE ns = ? ORDER BY id DESC LIMIT ?"
+	SQLiteSelectKeyAuditSQL = "SELECT id, ts, user, client, command, ns, k, old_value, new_value, err FROM __idgo_audit__ WHERE ns = ? AND k = ? ORDER BY id DESC LIMIT ?"
+
+	SQLiteDSNFormat      = "file:%s?_txlock=immediate&_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)"
+	DefaultSQLiteTimeout = 5000 // millisecond
+)
+
+// SQLiteStore stores every key as a row of the __idgo__ table in a sqlite
+// file, a segment is allocated in an immediate transaction.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(c *config.SQLiteConfig) (*SQLiteStore, error) {
+	if len(c.Path) == 0 {
+		return nil, fmt.Errorf("sqlite:have no path")
+	}
+	timeout := c.BusyTimeout
+	if timeout <= 0 {
+		timeout = DefaultSQLiteTimeout
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf(SQLiteDSNFormat, c.Path, timeout))
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Init() error {
+	_, err := s.db.Exec(CreateSQLiteRecordTableSQL)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(CreateSQLiteStepTableSQL)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(CreateSQLiteGenerationTableSQL)
+	return err
+}
+
+func (s *SQLiteStore) Keys() ([]string, error) {
+	keys := make([]string, 0)
+	rows, err := s.db.Query(SQLiteSelectKeysSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		idGenKey := ""
+		err := rows.Scan(&idGenKey)
+		if err != nil {
+			return nil, err
+		}
+		if idGenKey != "" {
+			keys = append(keys, idGenKey)
+		}
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) IsKeyExist(key string) (bool, error) {
+	var id int64
+	if len(key) == 0 {
+		return false, nil
+	}
+	err := s.db.QueryRow(SQLiteSelectIdSQL, key).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLiteStore) Current(key string) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(SQLiteSelectIdSQL, key).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s:have no id key", key)
+	}
+	return id, err
+}
+
+func (s *SQLiteStore) Fetch(key string, step int64) (int64, error) {
+	return s.FetchContext(context.Background(), key, step)
+}
+
+func (s *SQLiteStore) FetchContext(ctx context.Context, key string, step int64) (int64, error) {
+	var id int64
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, SQLiteSelectIdSQL, key).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		// When the idgo table has no id key
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%s:have no id key", key)
+		}
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, SQLiteUpdateIdSQL, step, key)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *SQLiteStore) Reset(key string, idOffset int64, force bool) (int64, error) {
+	if force {
+		_, err := s.db.Exec(SQLiteReplaceIdSQL, key, idOffset)
+		if err != nil {
+			return 0, err
+		}
+		return idOffset, nil
+	}
+
+	var id int64
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(SQLiteInsertIdSQL, key, idOffset)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.QueryRow(SQLiteSelectIdSQL, key).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *SQLiteStore) Delete(key string) error {
+	_, err := s.db.Exec(SQLiteDeleteKeySQL, key)
+	return err
+}
+
+func (s *SQLiteStore) Step(key string) (int64, error) {
+	var step int64
+	err := s.db.QueryRow(SQLiteSelectStepSQL, key).Scan(&step)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return step, err
+}
+
+func (s *SQLiteStore) SetStep(key string, step int64) error {
+	var err error
+	if step == 0 {
+		_, err = s.db.Exec(SQLiteDeleteStepSQL, key)
+	} else {
+		_, err = s.db.Exec(SQLiteReplaceStepSQL, key, step)
+	}
+	return err
+}
+
+func (s *SQLiteStore) InitAudit() error {
+	_, err := s.db.Exec(CreateSQLiteAuditTableSQL)
+	return err
+}
+
+func (s *SQLiteStore) AppendAudit(e *AuditEntry) error {
+	r, err := s.db.Exec(SQLiteInsertAuditSQL, auditArgs(e)...)
+	if err != nil {
+		return err
+	}
+	e.ID, err = r.LastInsertId()
+	return err
+}
+
+func (s *SQLiteStore) AuditEntries(ns int, key string, count int) ([]*AuditEntry, error) {
+	return queryAuditEntries(s.db, SQLiteSelectAuditSQL, SQLiteSelectKeyAuditSQL, ns, key, count)
+}
+
+func (s *SQLiteStore) DBs() map[string]*sql.DB {
+	return map[string]*sql.DB{StorageSQLite: s.db}
+}
+
+func (s *SQLiteStore) Generation(key string) (int64, error) {
+	var generation int64
+	err := s.db.QueryRow(SQLiteSelectGenerationSQL, key).Scan(&generation)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return generation, err
+}
+
+func (s *SQLiteStore) BumpGeneration(key string) error {
+	_, err := s.db.Exec(SQLiteBumpGenerationSQL, key)
+	return err
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
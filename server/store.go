@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	StorageMySQL  = "mysql"
+	StorageEtcd   = "etcd"
+	StorageRedis  = "redis"
+	StorageSQLite = "sqlite"
+)
+
+// SegmentStore persists the high-water mark of every id generator key,
+// the IdGenerator caches the segments allocated from it in memory.
+type SegmentStore interface {
+	// Init prepares the key registry of the store.
+	Init() error
+	// Keys returns all the keys registered in the store.
+	Keys() ([]string, error)
+	// IsKeyExist check the counter of key if exist.
+	IsKeyExist(key string) (bool, error)
+	// Current returns the high-water mark of key.
+	Current(key string) (int64, error)
+	// Fetch increases the high-water mark of key by step in one transaction,
+	// and returns the value before increasing.
+	Fetch(key string, step int64) (int64, error)
+	// Reset creates the counter of key with value and registers the key.
+	// If force is false and the counter exists, the value is kept.
+	// It returns the high-water mark of key after reset.
+	Reset(key string, value int64, force bool) (int64, error)
+	// Delete removes the counter of key and unregisters the key.
+	Delete(key string) error
+	Close() error
+}
+
+// BatchSizer is implemented by the stores whose keys must be fetched with a
+// fixed batch, BatchSize returns 0 when the batch of key is not fixed.
+type BatchSizer interface {
+	BatchSize(key string) int64
+}
+
+// ContextFetcher is implemented by the stores whose Fetch can be canceled,
+// the fetch transaction is aborted when ctx is done.
+type ContextFetcher interface {
+	FetchContext(ctx context.Context, key string, step int64) (int64, error)
+}
+
+// Backender is implemented by the stores over several backends which fail
+// apart, Backend returns the name of the backend of key. The fetches of
+// the keys of a backend share a circuit breaker.
+type Backender interface {
+	Backend(key string) string
+}
+
+// Pinger is implemented by the stores which can check the storage is
+// reachable without touching any key.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// StepStore is implemented by the stores which keep the step of every key,
+// the step is the count of ids of a segment fetched from the store.
+type StepStore interface {
+	// Step returns the step of key, 0 if it is not set.
+	Step(key string) (int64, error)
+	// SetStep sets the step of key, 0 removes the step.
+	SetStep(key string, step int64) error
+}
+
+// GenerationStore is implemented by the stores which keep a generation of
+// every key, the generation changes when the key is reset or deleted, so
+// the instances caching a segment of the key can find it is stale.
+type GenerationStore interface {
+	// Generation returns the generation of key, 0 if it never changed.
+	Generation(key string) (int64, error)
+	// BumpGeneration changes the generation of key, it is kept after the
+	// key is deleted.
+	BumpGeneration(key string) error
+}
+
+const (
+	DefaultShardName     = "default"
+	MultiMasterShardName = "multi_master_%d"
+)
+
+// NewSegmentStore creates the store of c.Storage, the keys of the
+// multi_master groups are placed on their own ModuloStore.
+func NewSegmentStore(c *config.Config) (SegmentStore, error) {
+	store, err := newStorageStore(c)
+	if err != nil || len(c.MultiMasters) == 0 {
+		return store, err
+	}
+
+	shards := []Shard{{Name: DefaultShardName, Store: store}}
+	placement := &config.PlacementConfig{
+		Policy:  PlacementMap,
+		Keys:    make(map[string]string),
+		Default: DefaultShardName,
+	}
+	closeAll := func() {
+		for _, shard := range shards {
+			shard.Store.Close()
+		}
+	}
+	for i, mc := range c.MultiMasters {
+		name := fmt.Sprintf(MultiMasterShardName, i)
+		mstore, err := NewMySQLModuloStore(mc)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		shards = append(shards, Shard{Name: name, Store: mstore})
+		for _, key := range mc.Keys {
+			if _, ok := placement.Keys[key]; ok {
+				closeAll()
+				return nil, fmt.Errorf("%s:key in several multi_master groups", key)
+			}
+			placement.Keys[key] = name
+		}
+	}
+	sstore, err := NewShardStore(shards, placement)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return sstore, nil
+}
+
+func newStorageStore(c *config.Config) (SegmentStore, error) {
+	switch c.Storage {
+	case "", StorageMySQL:
+		if len(c.DatabaseConfigs) != 0 {
+			return NewMySQLShardStore(c.DatabaseConfigs, c.Placement)
+		}
+		if c.DatabaseConfig == nil {
+			return nil, fmt.Errorf("storage %s:have no storage_db config", StorageMySQL)
+		}
+		return NewMySQLStore(c.DatabaseConfig)
+	case StorageEtcd:
+		if c.EtcdConfig == nil {
+			return nil, fmt.Errorf("storage %s:have no etcd config", StorageEtcd)
+		}
+		return NewEtcdStore(c.EtcdConfig)
+	case StorageRedis:
+		if c.RedisConfig == nil {
+			return nil, fmt.Errorf("storage %s:have no redis config", StorageRedis)
+		}
+		return NewRedisStore(c.RedisConfig)
+	case StorageSQLite:
+		if c.SQLiteConfig == nil {
+			return nil, fmt.Errorf("storage %s:have no sqlite config", StorageSQLite)
+		}
+		return NewSQLiteStore(c.SQLiteConfig)
+	default:
+		return nil, fmt.Errorf("%s:invalid storage", c.Storage)
+	}
+}
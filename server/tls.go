@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+
+	DefaultTLSReloadInterval = 60 // second
+	TLSHandshakeTimeout      = 10 * time.Second
+)
+
+// certLoader loads the certificate and the CA of the listener, and
+// reloads them when the files are changed.
+type certLoader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+	interval   time.Duration
+
+	lock      sync.RWMutex
+	config    *tls.Config
+	modTime   time.Time
+	checkTime time.Time
+}
+
+func newCertLoader(c *config.TLSConfig) (*certLoader, error) {
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		return nil, fmt.Errorf("tls:have no cert_file or key_file")
+	}
+	l := &certLoader{
+		certFile: c.CertFile,
+		keyFile:  c.KeyFile,
+		caFile:   c.CAFile,
+		interval: time.Duration(c.ReloadInterval) * time.Second,
+	}
+	if c.ReloadInterval <= 0 {
+		l.interval = DefaultTLSReloadInterval * time.Second
+	}
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+		l.clientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		l.clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		l.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls:%s:invalid client_auth", c.ClientAuth)
+	}
+	if l.clientAuth != tls.NoClientCert && len(l.caFile) == 0 {
+		return nil, fmt.Errorf("tls:client_auth %s needs ca_file", c.ClientAuth)
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// latestModTime returns the latest modification time of the files
+func (l *certLoader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{l.certFile, l.keyFile, l.caFile} {
+		if len(f) == 0 {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the files, the current certificate is kept if failed.
+func (l *certLoader) Reload() error {
+	modTime, err := l.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   l.clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(l.caFile) != 0 {
+		data, err := os.ReadFile(l.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tls:%s:have no certificate", l.caFile)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	l.lock.Lock()
+	l.config = cfg
+	l.modTime = modTime
+	l.checkTime = time.Now()
+	l.lock.Unlock()
+	return nil
+}
+
+// getConfig returns the current config, and reloads the files if they
+// are changed since the last check interval ago.
+func (l *certLoader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	l.lock.RLock()
+	cfg := l.config
+	due := time.Since(l.checkTime) >= l.interval
+	modTime := l.modTime
+	l.lock.RUnlock()
+	if !due {
+		return cfg, nil
+	}
+
+	l.lock.Lock()
+	l.checkTime = time.Now()
+	l.lock.Unlock()
+	latest, err := l.latestModTime()
+	if err != nil || !latest.After(modTime) {
+		return cfg, nil
+	}
+	if err = l.Reload(); err != nil {
+		logger.Error("reload certificate error",
+			"err", err,
+		)
+		return cfg, nil
+	}
+	logger.Info("certificate reloaded",
+		"cert", l.certFile,
+	)
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.config, nil
+}
+
+// peerSubject returns the subject and the common name of the verified
+// client certificate, they are empty if there is no verified certificate.
+func peerSubject(conn *tls.Conn) (string, string) {
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ""
+	}
+	cert := state.VerifiedChains[0][0]
+	return cert.Subject.String(), cert.Subject.CommonName
+}
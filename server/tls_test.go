@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flike/idgo/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"idgo"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keyFile) == 0 {
+		return
+	}
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "idgo-ca", 1, nil)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	newTestCert(t, "idgo-server", 2, ca).write(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	clientCert := newTestCert(t, "order-service", 3, ca)
+
+	certs, err := newCertLoader(&config.TLSConfig{
+		CertFile:   filepath.Join(dir, "server.pem"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ClientAuth: ClientAuthRequire,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := newTestServer(t)
+	s.acl, err = NewACL([]*config.UserConfig{
+		{Name: "order", CertCN: "order-service", Commands: []string{"read"}, Keys: []string{"order*"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.certs = certs
+	s.listener = tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: s.getTLSConfig,
+	})
+	defer s.listener.Close()
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.onConn(conn)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+	}
+	send := func(conn *tls.Conn, cmd string) string {
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return line
+	}
+
+	conn, err := dial(clientCert.tlsCertificate())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	// authenticated as the user of the certificate
+	if got := send(conn, "*2\r\n$6\r\nEXISTS\r\n$8\r\norder_id\r\n"); got != ":0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := send(conn, "*2\r\n$6\r\nEXISTS\r\n$7\r\nuser_id\r\n"); got[0] != '-' {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// the client certificate is required
+	conn2, err := dial()
+	if err == nil {
+		conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn2.Read(make([]byte, 1))
+		conn2.Close()
+	}
+	if err == nil {
+		t.Fatal("connection without client certificate should fail")
+	}
+
+	// the new certificate is served after reload
+	newTestCert(t, "idgo-server", 4, ca).write(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn3, err := dial(clientCert.tlsCertificate())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn3.Close()
+	if serial := conn3.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("expect the reloaded certificate, got serial %d", serial)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/flike/idgo/config"
+)
+
+const (
+	TracingExporterNone = "none"
+	TracingExporterOTLP = "otlp"
+
+	DefaultTracingServiceName = "idgo"
+	DefaultTracingEndpoint    = "127.0.0.1:4317"
+	TracingShutdownTimeout    = 5 * time.Second
+)
+
+// the spans are no-op until a tracer provider is set by initTracing
+var tracer = otel.Tracer("github.com/flike/idgo/server")
+
+// initTracing sets the global tracer provider of c,
+// it returns the function to flush and stop the exporter.
+func initTracing(c *config.TracingConfig) (func() error, error) {
+	noop := func() error { return nil }
+	if c == nil {
+		return noop, nil
+	}
+	switch c.Exporter {
+	case "", TracingExporterNone:
+		return noop, nil
+	case TracingExporterOTLP:
+	default:
+		return nil, fmt.Errorf("tracing:%s:invalid exporter", c.Exporter)
+	}
+
+	endpoint := c.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = DefaultTracingEndpoint
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := c.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = DefaultTracingServiceName
+	}
+	sampler := sdktrace.ParentBased(sdktrace.AlwaysSample())
+	if c.SampleRatio > 0 && c.SampleRatio < 1 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), TracingShutdownTimeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}, nil
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func keyAttribute(key string) attribute.KeyValue {
+	return attribute.String("idgo.key", key)
+}
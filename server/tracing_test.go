@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	s := newTestServer(t)
+	s.ServeRequest(newTestRequest("SET", "trace_key", "1"))
+	s.ServeRequest(newTestRequest("GET", "trace_key"))
+	s.ServeRequest(newTestRequest("GET", "a'b"))
+
+	spans := recorder.Ended()
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	expect := []string{
+		"IdGenerator.lock", "SegmentStore.Reset", "idgo.SET",
+		"IdGenerator.lock", "SegmentStore.Fetch", "idgo.GET",
+		"idgo.GET",
+	}
+	if len(names) != len(expect) {
+		t.Fatalf("unexpected spans %v", names)
+	}
+	for i := range expect {
+		if names[i] != expect[i] {
+			t.Fatalf("unexpected spans %v", names)
+		}
+	}
+
+	// the storage spans are children of the request span
+	get := spans[5]
+	for _, span := range spans[3:5] {
+		if span.Parent().SpanID() != get.SpanContext().SpanID() {
+			t.Fatalf("%s is not a child of %s", span.Name(), get.Name())
+		}
+	}
+	if spans[6].Status().Description != "invalid key" {
+		t.Fatalf("unexpected status %v", spans[6].Status())
+	}
+}